@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"repack/urlsign"
+	"time"
+)
+
+// URLSignSecret verifies the signed urls, the requests are rejected if it's
+// empty unless URLSignDisabled
+var URLSignSecret = os.Getenv("URL_SIGN_SECRET")
+
+// URLSignDisabled turns off the url signing by URL_SIGN_DISABLED=1, e.g. the
+// service is only reachable from a trusted network
+var URLSignDisabled = os.Getenv("URL_SIGN_DISABLED") == "1"
+
+var errNoSignSecret = errors.New("URL_SIGN_SECRET is not set, set URL_SIGN_DISABLED=1 to serve unsigned urls")
+
+// checkURLSign reports whether the signed urls can be verified
+func checkURLSign() error {
+	if URLSignSecret == "" && !URLSignDisabled {
+		return errNoSignSecret
+	}
+	return nil
+}
+
+// verifyURL checks the signature of the request url for src and cid, the
+// requests of several channels sign urlsign.Batch in place of cid
+func verifyURL(r *http.Request, src, cid string) error {
+	if URLSignDisabled {
+		return nil
+	}
+	if err := checkURLSign(); err != nil {
+		return err
+	}
+	return urlsign.Verify([]byte(URLSignSecret), r.URL.Query(), src, cid, time.Now())
+}
@@ -0,0 +1,409 @@
+// Package axml reads and edits the binary xml of AndroidManifest.xml in the
+// apk. Only the values of the <meta-data> elements are edited, the new values
+// are appended to the string pool so the existing references are kept.
+package axml
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// chunk types
+const (
+	resStringPoolType  = 0x0001
+	resXMLType         = 0x0003
+	resXMLStartElement = 0x0102
+	resXMLResourceMap  = 0x0180
+)
+
+// string pool flags
+const (
+	sortedFlag = 1 << 0
+	utf8Flag   = 1 << 8
+)
+
+// value types of the attributes
+const (
+	typeString = 0x03
+)
+
+// resource ids of the android attributes
+const (
+	attrName  = 0x01010003
+	attrValue = 0x01010024
+)
+
+const noEntry = 0xffffffff
+
+// ErrNotFound is returned if the meta-data is not in the manifest
+var ErrNotFound = errors.New("axml: meta-data not found")
+
+// Document is a binary xml document
+type Document struct {
+	// header of the string pool chunk after the common fields
+	poolHeader []byte
+	strings    []string
+	styles     []uint32
+	styleData  []byte
+	utf8       bool
+	sorted     bool
+
+	// resIDs is the resource ids of the first strings
+	resIDs []uint32
+	// chunks after the string pool
+	chunks []byte
+}
+
+// Parse parses the binary xml in buf
+func Parse(buf []byte) (*Document, error) {
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("axml: too short: %d", len(buf))
+	}
+	typ, headerSize, size := chunkHeader(buf)
+	if typ != resXMLType || int(size) > len(buf) || int(headerSize) > int(size) {
+		return nil, fmt.Errorf("axml: invalid header, type: %#x, size: %d", typ, size)
+	}
+	buf = buf[headerSize:size]
+
+	d := &Document{}
+	if len(buf) < 8 {
+		return nil, fmt.Errorf("axml: missing string pool")
+	}
+	typ, _, size = chunkHeader(buf)
+	if typ != resStringPoolType || int(size) > len(buf) {
+		return nil, fmt.Errorf("axml: invalid string pool, type: %#x, size: %d", typ, size)
+	}
+	if err := d.parsePool(buf[:size]); err != nil {
+		return nil, err
+	}
+	d.chunks = buf[size:]
+
+	// the resource map of the attribute names
+	if len(d.chunks) >= 8 {
+		typ, headerSize, size := chunkHeader(d.chunks)
+		if typ == resXMLResourceMap && int(size) <= len(d.chunks) && uint32(headerSize) <= size {
+			for p := int(headerSize); p+4 <= int(size); p += 4 {
+				d.resIDs = append(d.resIDs, binary.LittleEndian.Uint32(d.chunks[p:]))
+			}
+		}
+	}
+	return d, nil
+}
+
+func chunkHeader(buf []byte) (typ, headerSize uint16, size uint32) {
+	return binary.LittleEndian.Uint16(buf), binary.LittleEndian.Uint16(buf[2:]),
+		binary.LittleEndian.Uint32(buf[4:])
+}
+
+func (d *Document) parsePool(buf []byte) error {
+	_, headerSize, _ := chunkHeader(buf)
+	if headerSize < 28 || int(headerSize) > len(buf) {
+		return fmt.Errorf("axml: invalid string pool header size: %d", headerSize)
+	}
+	le := binary.LittleEndian
+	stringCount := int(le.Uint32(buf[8:]))
+	styleCount := int(le.Uint32(buf[12:]))
+	flags := le.Uint32(buf[16:])
+	stringsStart := int(le.Uint32(buf[20:]))
+	stylesStart := int(le.Uint32(buf[24:]))
+	d.poolHeader = append([]byte{}, buf[28:headerSize]...)
+	d.utf8 = flags&utf8Flag != 0
+	d.sorted = flags&sortedFlag != 0
+
+	offsets := int(headerSize)
+	if offsets+4*(stringCount+styleCount) > len(buf) || stringsStart > len(buf) {
+		return fmt.Errorf("axml: invalid string pool, strings: %d, styles: %d", stringCount, styleCount)
+	}
+	for i := 0; i < stringCount; i++ {
+		off := stringsStart + int(le.Uint32(buf[offsets+4*i:]))
+		s, err := decodeString(buf, off, d.utf8)
+		if err != nil {
+			return fmt.Errorf("axml: string %d: %v", i, err)
+		}
+		d.strings = append(d.strings, s)
+	}
+	if styleCount > 0 {
+		if stylesStart > len(buf) {
+			return fmt.Errorf("axml: invalid styles start: %d", stylesStart)
+		}
+		for i := 0; i < styleCount; i++ {
+			d.styles = append(d.styles, le.Uint32(buf[offsets+4*(stringCount+i):]))
+		}
+		d.styleData = append([]byte{}, buf[stylesStart:]...)
+	}
+	return nil
+}
+
+func decodeString(buf []byte, off int, isUTF8 bool) (string, error) {
+	if off < 0 || off+2 > len(buf) {
+		return "", fmt.Errorf("invalid offset: %d", off)
+	}
+	if isUTF8 {
+		// the utf-16 length followed by the utf-8 length
+		_, n := decodeLength8(buf[off:])
+		size, m := decodeLength8(buf[off+n:])
+		start := off + n + m
+		if start+size > len(buf) {
+			return "", fmt.Errorf("invalid length: %d", size)
+		}
+		return string(buf[start : start+size]), nil
+	}
+
+	size, n := decodeLength16(buf[off:])
+	start := off + n
+	if start+2*size > len(buf) {
+		return "", fmt.Errorf("invalid length: %d", size)
+	}
+	units := make([]uint16, size)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(buf[start+2*i:])
+	}
+	return string(utf16.Decode(units)), nil
+}
+
+func decodeLength8(buf []byte) (int, int) {
+	if len(buf) == 0 {
+		return 0, 1
+	}
+	if buf[0]&0x80 != 0 && len(buf) > 1 {
+		return int(buf[0]&0x7f)<<8 | int(buf[1]), 2
+	}
+	return int(buf[0]), 1
+}
+
+func decodeLength16(buf []byte) (int, int) {
+	l := binary.LittleEndian.Uint16(buf)
+	if l&0x8000 != 0 && len(buf) >= 4 {
+		return int(l&0x7fff)<<16 | int(binary.LittleEndian.Uint16(buf[2:])), 4
+	}
+	return int(l), 2
+}
+
+func appendLength8(buf []byte, l int) []byte {
+	if l > 0x7f {
+		return append(buf, byte(l>>8)|0x80, byte(l))
+	}
+	return append(buf, byte(l))
+}
+
+func appendLength16(buf []byte, l int) []byte {
+	if l > 0x7fff {
+		buf = appendUint16(buf, uint16(l>>16)|0x8000)
+	}
+	return appendUint16(buf, uint16(l))
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// encodePool returns the string pool chunk
+func (d *Document) encodePool() []byte {
+	var data []byte
+	offsets := make([]uint32, len(d.strings))
+	for i, s := range d.strings {
+		offsets[i] = uint32(len(data))
+		if d.utf8 {
+			data = appendLength8(data, len(utf16.Encode([]rune(s))))
+			data = appendLength8(data, len(s))
+			data = append(data, s...)
+			data = append(data, 0)
+		} else {
+			units := utf16.Encode([]rune(s))
+			data = appendLength16(data, len(units))
+			for _, u := range units {
+				data = appendUint16(data, u)
+			}
+			data = appendUint16(data, 0)
+		}
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	headerSize := 28 + len(d.poolHeader)
+	stringsStart := headerSize + 4*(len(d.strings)+len(d.styles))
+	stylesStart := 0
+	if len(d.styles) > 0 {
+		stylesStart = stringsStart + len(data)
+	}
+	size := stringsStart + len(data) + len(d.styleData)
+
+	flags := uint32(0)
+	if d.utf8 {
+		flags |= utf8Flag
+	}
+	if d.sorted {
+		flags |= sortedFlag
+	}
+
+	buf := make([]byte, 0, size)
+	buf = appendUint16(buf, resStringPoolType)
+	buf = appendUint16(buf, uint16(headerSize))
+	buf = appendUint32(buf, uint32(size))
+	buf = appendUint32(buf, uint32(len(d.strings)))
+	buf = appendUint32(buf, uint32(len(d.styles)))
+	buf = appendUint32(buf, flags)
+	buf = appendUint32(buf, uint32(stringsStart))
+	buf = appendUint32(buf, uint32(stylesStart))
+	buf = append(buf, d.poolHeader...)
+	for _, off := range offsets {
+		buf = appendUint32(buf, off)
+	}
+	for _, off := range d.styles {
+		buf = appendUint32(buf, off)
+	}
+	buf = append(buf, data...)
+	return append(buf, d.styleData...)
+}
+
+// Bytes returns the binary xml of d
+func (d *Document) Bytes() []byte {
+	pool := d.encodePool()
+	size := 8 + len(pool) + len(d.chunks)
+	buf := make([]byte, 0, size)
+	buf = appendUint16(buf, resXMLType)
+	buf = appendUint16(buf, 8)
+	buf = appendUint32(buf, uint32(size))
+	buf = append(buf, pool...)
+	return append(buf, d.chunks...)
+}
+
+// attribute is an attribute of a start element in d.chunks
+type attribute struct {
+	// offset of the attribute in d.chunks
+	offset int
+	name   uint32
+}
+
+func (a attribute) rawValue(chunks []byte) uint32 {
+	return binary.LittleEndian.Uint32(chunks[a.offset+8:])
+}
+
+func (a attribute) dataType(chunks []byte) byte {
+	return chunks[a.offset+15]
+}
+
+func (a attribute) data(chunks []byte) uint32 {
+	return binary.LittleEndian.Uint32(chunks[a.offset+16:])
+}
+
+// isAttr reports whether the string ref is the android attribute of resID
+// or named name
+func (d *Document) isAttr(ref, resID uint32, name string) bool {
+	if int(ref) < len(d.resIDs) && d.resIDs[ref] != 0 {
+		return d.resIDs[ref] == resID
+	}
+	return int(ref) < len(d.strings) && d.strings[ref] == name
+}
+
+func (d *Document) stringAt(ref uint32) string {
+	if ref == noEntry || int(ref) >= len(d.strings) {
+		return ""
+	}
+	return d.strings[ref]
+}
+
+// metaData calls fn with the name and value attributes of each <meta-data>
+func (d *Document) metaData(fn func(name string, value *attribute) error) error {
+	le := binary.LittleEndian
+	for p := 0; p+8 <= len(d.chunks); {
+		typ, headerSize, size := chunkHeader(d.chunks[p:])
+		if size < 8 || p+int(size) > len(d.chunks) {
+			return fmt.Errorf("axml: invalid chunk at %d, size: %d", p, size)
+		}
+		chunk := d.chunks[p : p+int(size)]
+		if typ == resXMLStartElement && int(headerSize)+20 <= len(chunk) {
+			ext := chunk[headerSize:]
+			elemName := d.stringAt(le.Uint32(ext[4:]))
+			attrStart, attrSize, attrCount := int(le.Uint16(ext[8:])), int(le.Uint16(ext[10:])), int(le.Uint16(ext[12:]))
+			if elemName == "meta-data" && attrSize >= 20 && int(headerSize)+attrStart+attrSize*attrCount <= len(chunk) {
+				var name string
+				var value *attribute
+				for i := 0; i < attrCount; i++ {
+					off := p + int(headerSize) + attrStart + attrSize*i
+					a := attribute{offset: off, name: le.Uint32(d.chunks[off+4:])}
+					switch {
+					case d.isAttr(a.name, attrName, "name"):
+						name = d.stringAt(a.rawValue(d.chunks))
+						if a.dataType(d.chunks) == typeString {
+							name = d.stringAt(a.data(d.chunks))
+						}
+					case d.isAttr(a.name, attrValue, "value"):
+						value = &a
+					}
+				}
+				if name != "" {
+					if err := fn(name, value); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		p += int(size)
+	}
+	return nil
+}
+
+// MetaData returns the values of the <meta-data> elements, the value is
+// empty if not a string
+func (d *Document) MetaData() (map[string]string, error) {
+	res := map[string]string{}
+	err := d.metaData(func(name string, value *attribute) error {
+		res[name] = ""
+		if value != nil {
+			if value.dataType(d.chunks) == typeString {
+				res[name] = d.stringAt(value.data(d.chunks))
+			} else {
+				res[name] = d.stringAt(value.rawValue(d.chunks))
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SetMetaData sets the value of the <meta-data> of name to the string value,
+// ErrNotFound is returned if there is no such meta-data with a value
+func (d *Document) SetMetaData(name, value string) error {
+	found := false
+	err := d.metaData(func(n string, attr *attribute) error {
+		if n != name || attr == nil {
+			return nil
+		}
+		ref := d.addString(value)
+		le := binary.LittleEndian
+		le.PutUint32(d.chunks[attr.offset+8:], ref)
+		le.PutUint16(d.chunks[attr.offset+12:], 8)
+		d.chunks[attr.offset+14] = 0
+		d.chunks[attr.offset+15] = typeString
+		le.PutUint32(d.chunks[attr.offset+16:], ref)
+		found = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return nil
+}
+
+// addString appends s to the string pool, the pool is not sorted anymore
+func (d *Document) addString(s string) uint32 {
+	for i := len(d.resIDs); i < len(d.strings); i++ {
+		if d.strings[i] == s {
+			return uint32(i)
+		}
+	}
+	d.strings = append(d.strings, s)
+	d.sorted = false
+	return uint32(len(d.strings) - 1)
+}
@@ -0,0 +1,301 @@
+package axml
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// realManifest is compiled by aapt2, it's the test manifest of
+// github.com/shogo82148/androidbinary (MIT) with the string, int, bool and
+// resource reference meta-data
+const realManifest = "testdata/AndroidManifest.xml"
+
+const androidNS = "http://schemas.android.com/apk/res/android"
+
+// buildManifest returns a minimal binary manifest with the string meta-data
+// UMENG_CHANNEL=placeholder and the int meta-data NUM=123, the string pool is
+// utf-8 or utf-16
+func buildManifest(isUTF8 bool) []byte {
+	strs := []string{"name", "value", "android", androidNS, "manifest", "application",
+		"meta-data", "UMENG_CHANNEL", "placeholder", "NUM", "package", "com.example", "中文"}
+	index := func(s string) uint32 {
+		for i, v := range strs {
+			if v == s {
+				return uint32(i)
+			}
+		}
+		panic(s)
+	}
+
+	d := &Document{strings: strs, utf8: isUTF8, poolHeader: []byte{}}
+	var body []byte
+	body = append(body, d.encodePool()...)
+	// the resource ids of name and value
+	body = appendUint16(body, resXMLResourceMap)
+	body = appendUint16(body, 8)
+	body = appendUint32(body, 16)
+	body = appendUint32(body, attrName)
+	body = appendUint32(body, attrValue)
+
+	type attr struct {
+		ns, name, raw uint32
+		typ           byte
+		data          uint32
+	}
+	str := func(ns uint32, name, value string) attr {
+		return attr{ns, index(name), index(value), typeString, index(value)}
+	}
+	ns := index(androidNS)
+	start := func(name string, attrs ...attr) {
+		size := 36 + 20*len(attrs)
+		body = appendUint16(body, resXMLStartElement)
+		body = appendUint16(body, 16)
+		body = appendUint32(body, uint32(size))
+		body = appendUint32(body, 1)
+		body = appendUint32(body, noEntry)
+		body = appendUint32(body, noEntry)
+		body = appendUint32(body, index(name))
+		body = appendUint16(body, 20)
+		body = appendUint16(body, 20)
+		body = appendUint16(body, uint16(len(attrs)))
+		body = append(body, 0, 0, 0, 0, 0, 0)
+		for _, a := range attrs {
+			body = appendUint32(body, a.ns)
+			body = appendUint32(body, a.name)
+			body = appendUint32(body, a.raw)
+			body = appendUint16(body, 8)
+			body = append(body, 0, a.typ)
+			body = appendUint32(body, a.data)
+		}
+	}
+	end := func(name string) {
+		body = appendUint16(body, 0x0103)
+		body = appendUint16(body, 16)
+		body = appendUint32(body, 24)
+		body = appendUint32(body, 1)
+		body = appendUint32(body, noEntry)
+		body = appendUint32(body, noEntry)
+		body = appendUint32(body, index(name))
+	}
+	start("manifest", str(noEntry, "package", "com.example"))
+	start("application")
+	start("meta-data", str(ns, "name", "UMENG_CHANNEL"), str(ns, "value", "placeholder"))
+	end("meta-data")
+	start("meta-data", str(ns, "name", "NUM"), attr{ns, index("value"), noEntry, 0x10, 123})
+	end("meta-data")
+	end("application")
+	end("manifest")
+
+	buf := appendUint16(nil, resXMLType)
+	buf = appendUint16(buf, 8)
+	buf = appendUint32(buf, uint32(8+len(body)))
+	return append(buf, body...)
+}
+
+func readManifest(t *testing.T) []byte {
+	buf, err := ioutil.ReadFile(realManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestParseBytes(t *testing.T) {
+	cases := []struct {
+		name   string
+		buf    []byte
+		isUTF8 bool
+	}{
+		{"aapt2", readManifest(t), false},
+		{"utf16", buildManifest(false), false},
+		{"utf8", buildManifest(true), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := Parse(c.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.utf8 != c.isUTF8 {
+				t.Errorf("utf8 = %v, want %v", d.utf8, c.isUTF8)
+			}
+			if !bytes.Equal(d.Bytes(), c.buf) {
+				t.Errorf("Bytes() differs from the parsed manifest")
+			}
+		})
+	}
+}
+
+func TestMetaData(t *testing.T) {
+	cases := []struct {
+		name string
+		buf  []byte
+		want map[string]string
+	}{
+		{"aapt2", readManifest(t), map[string]string{
+			"string_test":          "hogefuga",
+			"string_test_arsc":     "",
+			"int_test":             "",
+			"int_test_arsc":        "",
+			"bool_test_true":       "",
+			"bool_test_true_arsc":  "",
+			"bool_test_false":      "",
+			"bool_test_false_arsc": "",
+		}},
+		{"utf16", buildManifest(false), map[string]string{"UMENG_CHANNEL": "placeholder", "NUM": ""}},
+		{"utf8", buildManifest(true), map[string]string{"UMENG_CHANNEL": "placeholder", "NUM": ""}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := Parse(c.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.MetaData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(c.want) {
+				t.Errorf("MetaData() = %v, want %v", got, c.want)
+			}
+			for k, v := range c.want {
+				if got[k] != v {
+					t.Errorf("MetaData()[%s] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestSetMetaData(t *testing.T) {
+	long := strings.Repeat("渠道", 100)
+	cases := []struct {
+		name    string
+		buf     []byte
+		key     string
+		value   string
+		wantErr error
+	}{
+		{"aapt2 string", readManifest(t), "string_test", "xiaomi", nil},
+		{"aapt2 int", readManifest(t), "int_test", "huawei", nil},
+		{"aapt2 reference", readManifest(t), "string_test_arsc", "oppo", nil},
+		{"aapt2 new key", readManifest(t), "UMENG_CHANNEL", "xiaomi", ErrNotFound},
+		{"utf16 string", buildManifest(false), "UMENG_CHANNEL", "xiaomi", nil},
+		{"utf16 multibyte", buildManifest(false), "UMENG_CHANNEL", "中文渠道😀", nil},
+		{"utf16 long", buildManifest(false), "UMENG_CHANNEL", long, nil},
+		{"utf16 new key", buildManifest(false), "CHANNEL", "xiaomi", ErrNotFound},
+		{"utf8 string", buildManifest(true), "UMENG_CHANNEL", "xiaomi", nil},
+		{"utf8 multibyte", buildManifest(true), "UMENG_CHANNEL", "中文渠道😀", nil},
+		{"utf8 long", buildManifest(true), "UMENG_CHANNEL", long, nil},
+		{"utf8 existing string", buildManifest(true), "NUM", "中文", nil},
+		{"utf8 new key", buildManifest(true), "CHANNEL", "xiaomi", ErrNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := Parse(c.buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := d.MetaData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = d.SetMetaData(c.key, c.value)
+			if c.wantErr != nil {
+				if !errors.Is(err, c.wantErr) {
+					t.Fatalf("SetMetaData() = %v, want %v", err, c.wantErr)
+				}
+				if !bytes.Equal(d.Bytes(), c.buf) {
+					t.Errorf("the manifest is changed on error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// re-parse the edited manifest
+			buf := d.Bytes()
+			edited, err := Parse(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if edited.utf8 != d.utf8 {
+				t.Errorf("utf8 = %v, want %v", edited.utf8, d.utf8)
+			}
+			if !bytes.Equal(edited.Bytes(), buf) {
+				t.Errorf("Bytes() of the re-parsed manifest differs")
+			}
+			got, err := edited.MetaData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range before {
+				if k == c.key {
+					v = c.value
+				}
+				if got[k] != v {
+					t.Errorf("MetaData()[%s] = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// TestPoolEncoding re-encodes the utf-16 pool of the aapt2 manifest in utf-8
+func TestPoolEncoding(t *testing.T) {
+	d, err := Parse(readManifest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{}, d.strings...)
+	d.utf8 = true
+	if err := d.SetMetaData("string_test", "中文"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Parse(d.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.utf8 {
+		t.Errorf("utf8 = false, want true")
+	}
+	want = append(want, "中文")
+	if len(res.strings) != len(want) {
+		t.Fatalf("strings: %d, want %d", len(res.strings), len(want))
+	}
+	for i, s := range want {
+		if res.strings[i] != s {
+			t.Errorf("string %d = %q, want %q", i, res.strings[i], s)
+		}
+	}
+	if md, _ := res.MetaData(); md["string_test"] != "中文" {
+		t.Errorf("string_test = %q, want 中文", md["string_test"])
+	}
+}
+
+func TestStringLength(t *testing.T) {
+	cases := []string{"", "a", strings.Repeat("a", 0x7f), strings.Repeat("a", 0x80),
+		strings.Repeat("中", 0x7f), strings.Repeat("中", 0x80), "😀", strings.Repeat("a", 0x8000)}
+	for _, s := range cases {
+		for _, isUTF8 := range []bool{false, true} {
+			if isUTF8 && len(s) > 0x7fff {
+				// the utf-8 length has at most 15 bits
+				continue
+			}
+			d := &Document{strings: []string{s}, utf8: isUTF8}
+			pool := d.encodePool()
+			res := &Document{}
+			if err := res.parsePool(pool); err != nil {
+				t.Fatalf("utf8 %v, length %d: %v", isUTF8, len(s), err)
+			}
+			if len(res.strings) != 1 || res.strings[0] != s {
+				t.Errorf("utf8 %v, length %d: decoded %d units", isUTF8, len(s), len(utf16.Encode([]rune(res.strings[0]))))
+			}
+		}
+	}
+}
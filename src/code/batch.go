@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"repack/urlsign"
+	"sync"
+)
+
+// consts ...
+const (
+	BatchWorkerCount    = 8
+	MaxBatchWorkerCount = 32
+	MaxBatchChannels    = 5000
+)
+
+// batchRequest is the POST body of a batch generation:
+// {"src": "bucket/app.apk", "channels": ["xiaomi", "huawei"], "concurrency": 8}
+type batchRequest struct {
+	SourceObject string   `json:"src"`
+	Channels     []string `json:"channels"`
+	Concurrency  int      `json:"concurrency"`
+}
+
+type batchResult struct {
+	ChannelID string `json:"channel"`
+	Status    string `json:"status"`
+	Size      int64  `json:"size,omitempty"`
+	ETag      string `json:"etag,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	SourceObject string        `json:"src"`
+	Succeeded    int           `json:"succeeded"`
+	Failed       int           `json:"failed"`
+	Results      []batchResult `json:"results"`
+}
+
+// workers returns the worker count of the batch within [1, MaxBatchWorkerCount]
+func (b *batchRequest) workers() int {
+	n := b.Concurrency
+	if n <= 0 {
+		n = BatchWorkerCount
+	}
+	if n > MaxBatchWorkerCount {
+		n = MaxBatchWorkerCount
+	}
+	if n > len(b.Channels) {
+		n = len(b.Channels)
+	}
+	return n
+}
+
+// generateFooter makes sure the footer of the channel is generated
+func generateFooter(srcCtx *FCContext, channelID string) batchResult {
+	res := batchResult{ChannelID: channelID, Status: "ok"}
+	fcCtx, err := srcCtx.WithChannel(channelID, nil)
+	if err != nil {
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+	f, info, err := repackAPK(fcCtx)
+	if err != nil {
+		fcCtx.Logger.Errorf("batch repack error: %v", err)
+		res.Status, res.Error = "error", err.Error()
+		return res
+	}
+	f.Close()
+	res.Size = info.Offset + info.FooterSize
+	res.ETag = info.ETag
+	return res
+}
+
+// runBatch runs generate for all channels with at most workers goroutines,
+// the results are in the order of channels
+func runBatch(channels []string, workers int, generate func(channelID string) batchResult) []batchResult {
+	results := make([]batchResult, len(channels))
+	indexes := make(chan int, len(channels))
+	for i := range channels {
+		indexes <- i
+	}
+	close(indexes)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range indexes {
+				results[idx] = generate(channels[idx])
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// dedupChannels removes the empty and repeated channels
+func dedupChannels(channels []string) []string {
+	seen := make(map[string]bool, len(channels))
+	res := []string{}
+	for _, cid := range channels {
+		if cid == "" || seen[cid] {
+			continue
+		}
+		seen[cid] = true
+		res = append(res, cid)
+	}
+	return res
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		handleError(w, r, fmt.Errorf("invalid batch request: %v", err))
+		return
+	}
+	if err := verifyURL(r, req.SourceObject, urlsign.Batch(urlsign.ActionBatch, req.Channels, nil)); err != nil {
+		handleErrorCode(w, r, 403, err)
+		return
+	}
+	req.Channels = dedupChannels(req.Channels)
+	if len(req.Channels) == 0 {
+		handleError(w, r, fmt.Errorf("no channel to generate"))
+		return
+	}
+	if len(req.Channels) > MaxBatchChannels {
+		handleError(w, r, fmt.Errorf("too many channels: %d, max: %d", len(req.Channels), MaxBatchChannels))
+		return
+	}
+	srcCtx, err := newSourceContext(r, req.SourceObject)
+	if err != nil {
+		handleError(w, r, fmt.Errorf("fail to NewFromContext due to  %w", err))
+		return
+	}
+
+	srcCtx.Logger.Infof("batch channels: %d, workers: %d", len(req.Channels), req.workers())
+	resp := batchResponse{
+		SourceObject: req.SourceObject,
+		Results: runBatch(req.Channels, req.workers(), func(channelID string) batchResult {
+			return generateFooter(srcCtx, channelID)
+		}),
+	}
+	resp.count()
+
+	writeJSON(w, 200, resp)
+}
+
+// count sets the succeeded and failed channels of the results
+func (resp *batchResponse) count() {
+	for _, res := range resp.Results {
+		if res.Status == "ok" {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+}
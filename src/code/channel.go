@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"repack/urlsign"
+	"strings"
+)
+
+// consts ...
+const (
+	// ChannelPayloadPrefix marks the query parameters of the payload fields,
+	// e.g. p.campaign=spring&p.invite=ABC
+	ChannelPayloadPrefix = urlsign.PayloadPrefix
+	// ChannelPayloadParam is the payload fields as base64url encoded json
+	// object, covered by the url signature like the other fields
+	ChannelPayloadParam = "payload"
+	// ChannelKeyName is the key of the channel id in the rendered payload
+	ChannelKeyName = "channel"
+
+	MaxPayloadFields      = 32
+	MaxPayloadValueLength = 256
+)
+
+var payloadKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// parsePayload reads the payload fields from the query parameters
+func parsePayload(query url.Values) (map[string]string, error) {
+	payload := map[string]string{}
+	if blob := query.Get(ChannelPayloadParam); blob != "" {
+		buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(blob, "="))
+		if err != nil {
+			return nil, badRequest("payload is not base64url encoded: %v", err)
+		}
+		if err := json.Unmarshal(buf, &payload); err != nil {
+			return nil, badRequest("payload is not a json object of strings: %v", err)
+		}
+	}
+	for k, v := range query {
+		if strings.HasPrefix(k, ChannelPayloadPrefix) && len(v) > 0 {
+			payload[strings.TrimPrefix(k, ChannelPayloadPrefix)] = v[0]
+		}
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	return payload, validatePayload(payload)
+}
+
+func validatePayload(payload map[string]string) error {
+	if len(payload) > MaxPayloadFields {
+		return badRequest("too many payload fields: %d, max: %d", len(payload), MaxPayloadFields)
+	}
+	for k, v := range payload {
+		if k == ChannelKeyName {
+			return badRequest("payload field %s is reserved for cid", k)
+		}
+		if !payloadKeyPattern.MatchString(k) {
+			return badRequest("payload field %q is invalid", k)
+		}
+		if len(v) > MaxPayloadValueLength {
+			return badRequest("payload field %s is too long: %d, max: %d", k, len(v), MaxPayloadValueLength)
+		}
+	}
+	return nil
+}
+
+// ChannelKey identifies the channel, its payload, channel file and extra
+// files in the file names
+func (ctx *FCContext) ChannelKey() string {
+	key := ctx.ChannelID
+	if len(ctx.ChannelPayload) > 0 {
+		sum := sha1.Sum([]byte(urlsign.Channel(ctx.ChannelID, ctx.ChannelPayload)))
+		key += "_" + hex.EncodeToString(sum[:8])
+	}
+	if h := ctx.ChannelFile.hash(); h != "" {
+		key += "_" + h
+	}
+	if h := ctx.extras.hash(); h != "" {
+		key += "_" + h
+	}
+	return key
+}
+
+// escapeProperty escapes s as a key or value of a java .properties file
+func escapeProperty(s string, isKey bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '=' || r == ':' || r == '#' || r == '!':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == ' ' && (isKey || i == 0):
+			b.WriteString(`\ `)
+		case r < 0x20 || r > 0x7e:
+			for _, c := range utf16Units(r) {
+				fmt.Fprintf(&b, `\u%04X`, c)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+func utf16Units(r rune) []uint16 {
+	if r < 0x10000 {
+		return []uint16{uint16(r)}
+	}
+	r -= 0x10000
+	return []uint16{uint16(0xd800 + (r>>10)&0x3ff), uint16(0xdc00 + r&0x3ff)}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"repack/packer"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// formats of the channel file
+const (
+	// FormatAuto writes the bare channel id without payload, otherwise a
+	// json object if the path ends with .json, or a .properties file
+	FormatAuto       = ""
+	FormatRaw        = "raw"
+	FormatProperties = "properties"
+	FormatJSON       = "json"
+	// FormatTemplate renders ChannelFile.Template with .Channel and .Payload
+	FormatTemplate = "template"
+	// FormatEmpty writes an empty file, the channel is in the path,
+	// e.g. META-INF/channel_{{.Channel}}
+	FormatEmpty = "empty"
+)
+
+// modes to write the channel
+const (
+	ModeFile    = packer.ModeFile
+	ModeComment = packer.ModeComment
+)
+
+// CPIDPath is the channel file of DefaultChannelFile
+const CPIDPath = "assets/dap.properties"
+
+// ChannelFile describes the channel file written into the apk of the
+// sources matching Source
+type ChannelFile struct {
+	// Source is the pattern of the sources as SourceAllowlist, all sources
+	// are matched if empty
+	Source string `json:"src"`
+	// Path is the template of the entry path, e.g. META-INF/channel_{{.Channel}}
+	Path string `json:"path"`
+	// Format is one of the Format consts
+	Format string `json:"format"`
+	// Key is the key of the channel id in the properties and json formats,
+	// ChannelKeyName if empty
+	Key string `json:"key"`
+	// Template is the template of the content in FormatTemplate
+	Template string `json:"template"`
+	// Mode is one of the Mode consts, ModeFile if empty
+	Mode string `json:"mode"`
+	// MetaData is the templates of the <meta-data> values in the binary
+	// AndroidManifest.xml by name, e.g. {"UMENG_CHANNEL": "{{.Channel}}"}
+	MetaData map[string]string `json:"meta_data"`
+	// Extras is the template of the storage location of the extra files,
+	// e.g. bucket/extras/{{.Channel}}/, the objects under it are written
+	// into the apk by their relative paths
+	Extras string `json:"extras"`
+
+	pathTmpl    *template.Template
+	contentTmpl *template.Template
+	metaTmpls   map[string]*template.Template
+	extrasTmpl  *template.Template
+}
+
+// DefaultChannelFile is used for the sources not matching any of ChannelFiles
+var DefaultChannelFile = &ChannelFile{Path: CPIDPath, Mode: ModeFile}
+
+// ChannelFiles is loaded from CHANNEL_FILES, a json array of ChannelFile, or
+// the path of a json file of it. The first one matching the source is used.
+var ChannelFiles []*ChannelFile
+
+// channelData is the data of the templates
+type channelData struct {
+	Channel string
+	Payload map[string]string
+}
+
+// loadChannelFiles parses the channel files of CHANNEL_FILES
+func loadChannelFiles(s string) ([]*ChannelFile, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	buf := []byte(s)
+	if !strings.HasPrefix(s, "[") {
+		var err error
+		if buf, err = ioutil.ReadFile(s); err != nil {
+			return nil, err
+		}
+	}
+	var files []*ChannelFile
+	if err := json.Unmarshal(buf, &files); err != nil {
+		return nil, fmt.Errorf("invalid channel files: %v", err)
+	}
+	for i, f := range files {
+		if err := f.init(); err != nil {
+			return nil, fmt.Errorf("channel file %d: %v", i, err)
+		}
+	}
+	return files, nil
+}
+
+func (f *ChannelFile) init() error {
+	if f.Path == "" {
+		f.Path = CPIDPath
+	}
+	var err error
+	if f.pathTmpl, err = template.New("path").Option("missingkey=zero").Parse(f.Path); err != nil {
+		return err
+	}
+	switch f.Format {
+	case FormatAuto, FormatRaw, FormatProperties, FormatJSON, FormatEmpty:
+	case FormatTemplate:
+		if f.contentTmpl, err = template.New("content").Option("missingkey=zero").Parse(f.Template); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format: %s", f.Format)
+	}
+	switch f.Mode {
+	case "":
+		f.Mode = ModeFile
+	case ModeFile, ModeComment:
+	default:
+		return fmt.Errorf("unknown mode: %s", f.Mode)
+	}
+	if (len(f.MetaData) > 0 || f.Extras != "") && f.Mode != ModeFile {
+		return fmt.Errorf("meta_data and extras require mode %s", ModeFile)
+	}
+	if f.Extras != "" {
+		if f.extrasTmpl, err = template.New("extras").Option("missingkey=zero").Parse(f.Extras); err != nil {
+			return err
+		}
+	}
+	f.metaTmpls = map[string]*template.Template{}
+	for name, value := range f.MetaData {
+		if f.metaTmpls[name], err = template.New(name).Option("missingkey=zero").Parse(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channelFileFor returns the channel file of the source object src
+func channelFileFor(src string) *ChannelFile {
+	for _, f := range ChannelFiles {
+		if f.Source == "" || matchSource(f.Source, src) {
+			return f
+		}
+	}
+	return DefaultChannelFile
+}
+
+// hash identifies the channel file in the file names of the cache, it's
+// empty for DefaultChannelFile so the cache of the default is kept
+func (f *ChannelFile) hash() string {
+	if f == nil || f == DefaultChannelFile {
+		return ""
+	}
+	buf, _ := json.Marshal([]interface{}{f.Path, f.Format, f.Key, f.Template, f.Mode, f.MetaData, f.Extras})
+	sum := sha1.Sum(buf)
+	return hex.EncodeToString(sum[:4])
+}
+
+// render returns the entry path and content of the channel file
+func (f *ChannelFile) render(channelID string, payload map[string]string) (string, string, error) {
+	name := f.Path
+	if f.pathTmpl != nil {
+		var err error
+		if name, err = f.renderTemplate(f.pathTmpl, channelID, payload); err != nil {
+			return "", "", fmt.Errorf("render channel file path: %v", err)
+		}
+	}
+	if err := packer.ValidateEntryPath(name); err != nil {
+		return "", "", err
+	}
+
+	key := f.Key
+	if key == "" {
+		key = ChannelKeyName
+	}
+	switch f.Format {
+	case FormatRaw:
+		return name, channelID, nil
+	case FormatEmpty:
+		return name, "", nil
+	case FormatProperties:
+		return name, renderProperties(key, channelID, payload), nil
+	case FormatJSON:
+		return name, renderJSON(key, channelID, payload), nil
+	case FormatTemplate:
+		content, err := f.renderTemplate(f.contentTmpl, channelID, payload)
+		if err != nil {
+			return "", "", fmt.Errorf("render channel file: %v", err)
+		}
+		return name, content, nil
+	}
+
+	if len(payload) == 0 {
+		return name, channelID, nil
+	}
+	if path.Ext(name) == ".json" {
+		return name, renderJSON(key, channelID, payload), nil
+	}
+	return name, renderProperties(key, channelID, payload), nil
+}
+
+// renderTemplate executes tmpl with the channel and its payload
+func (f *ChannelFile) renderTemplate(tmpl *template.Template, channelID string, payload map[string]string) (string, error) {
+	data := channelData{Channel: channelID, Payload: payload}
+	if data.Payload == nil {
+		data.Payload = map[string]string{}
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderMetaData returns the <meta-data> values by name
+func (f *ChannelFile) renderMetaData(channelID string, payload map[string]string) (map[string]string, error) {
+	res := map[string]string{}
+	for name, tmpl := range f.metaTmpls {
+		value, err := f.renderTemplate(tmpl, channelID, payload)
+		if err != nil {
+			return nil, fmt.Errorf("render meta-data %s: %v", name, err)
+		}
+		res[name] = value
+	}
+	return res, nil
+}
+
+func renderFields(key, channelID string, payload map[string]string) map[string]string {
+	fields := map[string]string{}
+	for k, v := range payload {
+		fields[k] = v
+	}
+	fields[key] = channelID
+	return fields
+}
+
+func renderJSON(key, channelID string, payload map[string]string) string {
+	buf, _ := json.Marshal(renderFields(key, channelID, payload))
+	return string(buf)
+}
+
+// renderProperties returns a .properties file of the fields sorted by key
+func renderProperties(key, channelID string, payload map[string]string) string {
+	fields := renderFields(key, channelID, payload)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(escapeProperty(k, true))
+		buf.WriteByte('=')
+		buf.WriteString(escapeProperty(fields[k], false))
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// channelFile returns the channel file of ctx, DefaultChannelFile if not set
+func (ctx *FCContext) channelFile() *ChannelFile {
+	if ctx.ChannelFile == nil {
+		return DefaultChannelFile
+	}
+	return ctx.ChannelFile
+}
+
+// packerChannel returns the channel written into the source
+func (ctx *FCContext) packerChannel() (*packer.Channel, error) {
+	f := ctx.channelFile()
+	name, content, err := f.render(ctx.ChannelID, ctx.ChannelPayload)
+	if err != nil {
+		return nil, err
+	}
+	ch := &packer.Channel{Mode: f.Mode, Path: name, Content: []byte(content)}
+	if f.Mode == ModeComment {
+		return ch, nil
+	}
+	if ch.MetaData, err = f.renderMetaData(ctx.ChannelID, ctx.ChannelPayload); err != nil {
+		return nil, err
+	}
+	if ch.Extras, err = fetchExtras(ctx); err != nil {
+		return nil, fmt.Errorf("fetch extras: %v", err)
+	}
+	return ch, nil
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"repack/logger"
+	"repack/packer"
+	"repack/urlsign"
+	"strings"
+)
+
+// OSSSourcePrefix marks the sources of the cli on oss, oss://bucket/objectkey,
+// the others are local files
+const OSSSourcePrefix = "oss://"
+
+// LocalSourceBucket is the bucket of the local sources in SourceObject, the
+// sources of the channel files match local/<absolute path>
+const LocalSourceBucket = "local"
+
+// errUsage is returned by the commands for the invalid arguments, the usage
+// is already printed
+var errUsage = errors.New("invalid arguments")
+
+// command is a subcommand of the cli, the server is started without one
+type command struct {
+	Name  string
+	Args  string
+	Short string
+	Run   func(args []string) error
+}
+
+// commands is set in init as the commands refer to it for the usage
+var commands []command
+
+func init() {
+	commands = []command{
+		{"repack", "-src <apk> -cid <channel>", "write the apk of the channel", repackCommand},
+		{"batch", "-src <apk> -channels <a,b,c> -o <dir>", "write the apks of the channels", batchCommand},
+		{"inspect", "<apk>", "print the channel and the signers of the apk", inspectCommand},
+		{"verify", "<apk>", "verify the v1 signature of the apk", verifyCommand},
+		{"extract-channel", "<apk>", "print the channel of the apk", extractChannelCommand},
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", c.Name, c.Short)
+	}
+	fmt.Fprintf(w, "\nthe apk is a local file or %sbucket/objectkey, the server is started without a command\n", OSSSourcePrefix)
+}
+
+// runCommand runs the command of the cli and returns the exit code
+func runCommand(name string, args []string) int {
+	// the allowlist protects the server, the cli reads the oss sources with
+	// the credentials of its user
+	if len(SourceAllowlist) == 0 {
+		SourceAllowlist = []string{SourceAllowAll}
+	}
+	for _, c := range commands {
+		if c.Name != name {
+			continue
+		}
+		err := c.Run(args)
+		switch err {
+		case nil, flag.ErrHelp:
+			return 0
+		case errUsage:
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+	printUsage(os.Stderr)
+	return 2
+}
+
+// cliOptions are the flags shared by the commands
+type cliOptions struct {
+	endpoint     string
+	channelFiles string
+	verbose      bool
+
+	// the signer of the repack and batch commands
+	cert string
+	key  string
+
+	// set up by setupRepack
+	signer   packer.Signer
+	cacheDir string
+}
+
+// newFlagSet returns the flags of the command with the shared ones
+func newFlagSet(name string) (*flag.FlagSet, *cliOptions) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, c := range commands {
+		if c.Name == name {
+			c := c
+			fs.Usage = func() {
+				fmt.Fprintf(fs.Output(), "usage: %s %s [flags] %s\n\n%s\n\n", filepath.Base(os.Args[0]), c.Name, c.Args, c.Short)
+				fs.PrintDefaults()
+			}
+		}
+	}
+	o := &cliOptions{}
+	fs.StringVar(&o.endpoint, "endpoint", os.Getenv("OSS_ENDPOINT"), "oss endpoint of the oss sources and the extras, default $OSS_ENDPOINT")
+	fs.StringVar(&o.channelFiles, "channel-files", "", "channel files in json or @file to read them from, default $CHANNEL_FILES")
+	fs.BoolVar(&o.verbose, "v", false, "write the debug logs")
+	return fs, o
+}
+
+// signerFlags adds the flags of the signer
+func (o *cliOptions) signerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.cert, "cert", CertPEM_PATH, "certificate pem of the signer")
+	fs.StringVar(&o.key, "key", PrivateKeyPEM_PATH, "private key pem of the signer")
+}
+
+// parse parses the flags and applies the shared ones
+func (o *cliOptions) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	if o.verbose {
+		logger.SetLevel(logger.DebugLevel)
+	} else if os.Getenv("LOG_LEVEL") == "" {
+		logger.SetLevel(logger.WarnLevel)
+	}
+	if o.channelFiles != "" {
+		s := o.channelFiles
+		if strings.HasPrefix(s, "@") {
+			buf, err := ioutil.ReadFile(s[1:])
+			if err != nil {
+				return err
+			}
+			s = string(buf)
+		}
+		files, err := loadChannelFiles(s)
+		if err != nil {
+			return fmt.Errorf("load channel files: %v", err)
+		}
+		ChannelFiles = files
+	}
+	return nil
+}
+
+// argSource returns the only positional argument, the apk
+func argSource(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", errUsage
+	}
+	return fs.Arg(0), nil
+}
+
+// setupRepack loads the signer and sets up the work dir of the footers,
+// the returned func removes it. The footers are not kept as the local
+// sources may change between the runs.
+func (o *cliOptions) setupRepack() (func(), error) {
+	signer, err := packer.LoadKeySigner(o.cert, o.key)
+	if err != nil {
+		return nil, fmt.Errorf("load signer: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "repack")
+	if err != nil {
+		return nil, err
+	}
+	o.signer, o.cacheDir = signer, dir
+	return func() { os.RemoveAll(dir) }, nil
+}
+
+// localSource is the local file of the source
+type localSource struct {
+	*os.File
+}
+
+func (s *localSource) Size() (int64, error) {
+	fi, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// sourceContext returns the context of src, a local file or an oss source
+// read with the credentials of the env ACCESS_KEY_ID, ACCESS_KEY_SECRET and
+// SECURITY_TOKEN. The local file is closed by closeSource.
+func (o *cliOptions) sourceContext(src string) (*FCContext, error) {
+	ctx := &FCContext{
+		OSSEndpoint: o.endpoint,
+		Credentials: Credentials{
+			AccessKeyID:     os.Getenv("ACCESS_KEY_ID"),
+			AccessKeySecret: os.Getenv("ACCESS_KEY_SECRET"),
+			SecurityToken:   os.Getenv("SECURITY_TOKEN"),
+		},
+		CacheDir: o.cacheDir,
+		Signer:   o.signer,
+		Logger:   logger.With("src", src),
+	}
+	if strings.HasPrefix(src, OSSSourcePrefix) {
+		ctx.SourceObject = strings.TrimPrefix(src, OSSSourcePrefix)
+		if err := validateSource(ctx.SourceObject); err != nil {
+			return nil, err
+		}
+	} else {
+		abs, err := filepath.Abs(src)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(abs)
+		if err != nil {
+			return nil, err
+		}
+		ctx.SourceObject = LocalSourceBucket + "/" + strings.TrimPrefix(filepath.ToSlash(abs), "/")
+		ctx.Source = &localSource{f}
+	}
+	ctx.ChannelFile = channelFileFor(ctx.SourceObject)
+	return ctx, nil
+}
+
+// closeSource closes the local source of ctx
+func closeSource(ctx *FCContext) {
+	if s, ok := ctx.Source.(*localSource); ok {
+		s.Close()
+	}
+}
+
+// repackToFile writes the repacked apk of fcCtx to name
+func repackToFile(fcCtx *FCContext, name string) (*resultInfo, error) {
+	footer, res, err := repackAPK(fcCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer footer.Close()
+	src, err := fcCtx.openSource()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range res.segments() {
+		var r readerAt = footer
+		if !s.Footer {
+			r = src
+		}
+		if _, err = io.Copy(f, io.NewSectionReader(r, s.Offset, s.Size)); err != nil {
+			break
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+	return res, nil
+}
+
+func printJSON(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+
+func repackCommand(args []string) error {
+	fs, o := newFlagSet("repack")
+	o.signerFlags(fs)
+	src := fs.String("src", "", "source apk, a local file or oss://bucket/objectkey")
+	cid := fs.String("cid", "", "channel id")
+	out := fs.String("o", "", "output file, default <name>_<cid>.apk in the current dir")
+	payload := urlsign.PayloadFlag{}
+	fs.Var(payload, "p", "channel payload field key=value, repeatable")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if *src == "" || *cid == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	cleanup, err := o.setupRepack()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	srcCtx, err := o.sourceContext(*src)
+	if err != nil {
+		return err
+	}
+	defer closeSource(srcCtx)
+	var fields map[string]string
+	if len(payload) > 0 {
+		fields = payload
+	}
+	fcCtx, err := srcCtx.WithChannel(*cid, fields)
+	if err != nil {
+		return err
+	}
+	name := *out
+	if name == "" {
+		name = fcCtx.NewApkFileName
+	}
+	if _, err := repackToFile(fcCtx, name); err != nil {
+		return err
+	}
+	fmt.Println(name)
+	return nil
+}
+
+func batchCommand(args []string) error {
+	fs, o := newFlagSet("batch")
+	o.signerFlags(fs)
+	src := fs.String("src", "", "source apk, a local file or oss://bucket/objectkey")
+	channels := fs.String("channels", "", "comma separated channel ids")
+	channelsFile := fs.String("channels-file", "", "file of the channel ids, one per line")
+	out := fs.String("o", ".", "output dir, the apks are named <name>_<cid>.apk")
+	workers := fs.Int("workers", BatchWorkerCount, "channels repacked concurrently")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	ids := strings.Split(*channels, ",")
+	if *channelsFile != "" {
+		buf, err := ioutil.ReadFile(*channelsFile)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, strings.Split(string(buf), "\n")...)
+	}
+	for i := range ids {
+		ids[i] = strings.TrimSpace(ids[i])
+	}
+	req := &batchRequest{SourceObject: *src, Channels: dedupChannels(ids), Concurrency: *workers}
+	if *src == "" || len(req.Channels) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return errUsage
+	}
+
+	cleanup, err := o.setupRepack()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	srcCtx, err := o.sourceContext(*src)
+	if err != nil {
+		return err
+	}
+	defer closeSource(srcCtx)
+	if err := os.MkdirAll(*out, os.ModePerm); err != nil {
+		return err
+	}
+
+	resp := batchResponse{
+		SourceObject: *src,
+		Results: runBatch(req.Channels, req.workers(), func(channelID string) batchResult {
+			res := batchResult{ChannelID: channelID, Status: "ok"}
+			fcCtx, err := srcCtx.WithChannel(channelID, nil)
+			var info *resultInfo
+			if err == nil {
+				info, err = repackToFile(fcCtx, filepath.Join(*out, fcCtx.NewApkFileName))
+			}
+			if err != nil {
+				res.Status, res.Error = "error", err.Error()
+				return res
+			}
+			res.Size = info.Offset + info.FooterSize
+			res.ETag = info.ETag
+			return res
+		}),
+	}
+	resp.count()
+	if err := printJSON(resp); err != nil {
+		return err
+	}
+	if resp.Failed > 0 {
+		return fmt.Errorf("%d of %d channels failed", resp.Failed, len(resp.Results))
+	}
+	return nil
+}
+
+// inspectSource reads the channel and the signers of the source of ctx, the
+// local file is inspected with all the channel files
+func inspectSource(ctx *FCContext) (*channelInfo, error) {
+	r, err := ctx.openSource()
+	if err != nil {
+		return nil, err
+	}
+	size, err := r.Size()
+	if err != nil {
+		return nil, fmt.Errorf("object size: %v", err)
+	}
+	candidates := inspectCandidates(ctx.SourceObject)
+	if ctx.Source != nil {
+		candidates = inspectCandidates("")
+	}
+	return inspectAPK(r, size, candidates)
+}
+
+func inspectCommand(args []string) error {
+	fs, o := newFlagSet("inspect")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	src, err := argSource(fs)
+	if err != nil {
+		return err
+	}
+	ctx, err := o.sourceContext(src)
+	if err != nil {
+		return err
+	}
+	defer closeSource(ctx)
+	info, err := inspectSource(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(info)
+}
+
+func verifyCommand(args []string) error {
+	fs, o := newFlagSet("verify")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	src, err := argSource(fs)
+	if err != nil {
+		return err
+	}
+	ctx, err := o.sourceContext(src)
+	if err != nil {
+		return err
+	}
+	defer closeSource(ctx)
+	r, err := ctx.openSource()
+	if err != nil {
+		return err
+	}
+	size, err := r.Size()
+	if err != nil {
+		return fmt.Errorf("object size: %v", err)
+	}
+	signatures, err := packer.Verify(r, size)
+	if err != nil {
+		return err
+	}
+	signers := []apkSigner{}
+	for _, s := range signatures {
+		signers = append(signers, apkSigner{
+			Scheme:      "v1",
+			File:        s.File,
+			Subject:     s.Cert.Subject.String(),
+			Fingerprint: certFingerprint(s.Cert),
+		})
+	}
+	return printJSON(signers)
+}
+
+func extractChannelCommand(args []string) error {
+	fs, o := newFlagSet("extract-channel")
+	asJSON := fs.Bool("json", false, "print the channel, its mode and payload in json")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	src, err := argSource(fs)
+	if err != nil {
+		return err
+	}
+	ctx, err := o.sourceContext(src)
+	if err != nil {
+		return err
+	}
+	defer closeSource(ctx)
+	info, err := inspectSource(ctx)
+	if err != nil {
+		return err
+	}
+	if info.Channel == "" {
+		return fmt.Errorf("no channel found")
+	}
+	if *asJSON {
+		return printJSON(struct {
+			Channel string            `json:"channel"`
+			Mode    string            `json:"mode"`
+			Payload map[string]string `json:"payload,omitempty"`
+		}{info.Channel, info.Mode, info.Payload})
+	}
+	fmt.Println(info.Channel)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Command signurl mints signed download urls of the repack service:
+//
+//	URL_SIGN_SECRET=xxx signurl -base https://apk-cdn.example.com/foo -src bucket/app.apk -cid xiaomi -ttl 24h
+//
+// Add the channel payload fields with -p, e.g. -p campaign=spring -p invite=ABC.
+// The requests of several channels sign the action and the channels, set
+// -action batch, publish or jobs and the comma separated channels in -cid, or
+// @file of the channels one per line, and the target dir of publish in -dst.
+// The routes of a job are signed with -job id.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"repack/urlsign"
+	"strings"
+	"time"
+)
+
+func main() {
+	payload := urlsign.PayloadFlag{}
+	base := flag.String("base", "", "base url of the service, the query string is printed if empty")
+	src := flag.String("src", "", "source object, bucket/objectkey")
+	cid := flag.String("cid", "", "channel id")
+	ttl := flag.Duration("ttl", 24*time.Hour, "validity of the url")
+	action := flag.String("action", "", "sign the action on the channels of -cid: batch, publish or jobs")
+	dst := flag.String("dst", "", "target dir of publish, bucket/dir/")
+	jobID := flag.String("job", "", "sign the routes of the job id")
+	secret := flag.String("secret", os.Getenv("URL_SIGN_SECRET"), "signing secret, default $URL_SIGN_SECRET")
+	flag.Var(payload, "p", "channel payload field key=value, repeatable")
+	flag.Parse()
+
+	if (*src == "" && *jobID == "") || *secret == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var query string
+	switch {
+	case *jobID != "":
+		query = urlsign.JobQuery([]byte(*secret), *jobID, *ttl).Encode()
+	case *action != "":
+		channels, err := parseChannels(*cid)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		params := map[string]string{}
+		if *dst != "" {
+			params["dst"] = *dst
+		}
+		query = urlsign.BatchQuery([]byte(*secret), *src, *action, channels, params, *ttl).Encode()
+	default:
+		query = urlsign.ChannelQuery([]byte(*secret), *src, *cid, payload, *ttl).Encode()
+	}
+	if *base == "" {
+		fmt.Println(query)
+		return
+	}
+	sep := "?"
+	if strings.Contains(*base, "?") {
+		sep = "&"
+	}
+	fmt.Println(*base + sep + query)
+}
+
+// parseChannels returns the comma separated channels of s, or the channels of
+// the file one per line if s is @file
+func parseChannels(s string) ([]string, error) {
+	if strings.HasPrefix(s, "@") {
+		buf, err := ioutil.ReadFile(s[1:])
+		if err != nil {
+			return nil, err
+		}
+		s = strings.Replace(string(buf), "\n", ",", -1)
+	}
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list, nil
+}
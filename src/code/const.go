@@ -20,6 +20,8 @@ const (
 	fcAccountID = "x-fc-account-id"
 	fcQualifier = "x-fc-qualifier"
 	fcVersionID = "x-fc-version-id"
+
+	fcInvocationType = "x-fc-invocation-type"
 )
 
 var (
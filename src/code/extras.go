@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"repack/oss"
+	"repack/packer"
+	"sort"
+	"strings"
+
+	aliyunoss "github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// limits of the extra files of a channel
+const (
+	MaxExtraFiles       = 100
+	MaxExtraSizeInBytes = 50 * 1024 * 1024
+)
+
+// extrasLocation returns the storage location of the extra files of the
+// channel, bucket/prefix/, it's empty if the channel file has no extras
+func (f *ChannelFile) extrasLocation(channelID string, payload map[string]string) (string, error) {
+	if f.extrasTmpl == nil {
+		return "", nil
+	}
+	location, err := f.renderTemplate(f.extrasTmpl, channelID, payload)
+	if err != nil {
+		return "", fmt.Errorf("render extras: %v", err)
+	}
+	if !strings.HasSuffix(location, "/") {
+		location += "/"
+	}
+	bucketAndPrefix := strings.SplitN(location, "/", 2)
+	if len(bucketAndPrefix) != 2 || bucketAndPrefix[0] == "" || strings.Contains(location, "..") {
+		return "", fmt.Errorf("invalid extras location: %s", location)
+	}
+	return location, nil
+}
+
+// listExtras lists the extra files of the channel under its extras location,
+// the objects are nil if the channel file has no extras
+func listExtras(fcCtx *FCContext) (*channelExtras, error) {
+	f := fcCtx.channelFile()
+	if f.Mode != ModeFile {
+		return nil, nil
+	}
+	location, err := f.extrasLocation(fcCtx.ChannelID, fcCtx.ChannelPayload)
+	if err != nil || location == "" {
+		return nil, err
+	}
+
+	objects, err := oss.List(fcCtx.OSSConfig(), location, MaxExtraFiles)
+	if err != nil {
+		return nil, fmt.Errorf("list extras: %v", err)
+	}
+	size := int64(0)
+	for _, o := range objects {
+		size += o.Size
+	}
+	if size > MaxExtraSizeInBytes {
+		return nil, fmt.Errorf("extras are too large: %d, max: %d", size, MaxExtraSizeInBytes)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return &channelExtras{Location: location, Objects: objects}, nil
+}
+
+// channelExtras is the listed extra files of the channel
+type channelExtras struct {
+	Location string
+	Objects  []aliyunoss.ObjectProperties
+}
+
+// hash identifies the extra files by their names and etags, the footer is
+// regenerated if any of them is changed
+func (e *channelExtras) hash() string {
+	if e == nil {
+		return ""
+	}
+	h := sha1.New()
+	for _, o := range e.Objects {
+		fmt.Fprintf(h, "%s\n%s\n", o.Key, o.ETag)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// fetchExtras reads the extra files of the channel listed by WithChannel, the
+// object under the extras location is written to the entry of its relative
+// path, e.g. bucket/extras/xiaomi/assets/splash.png to assets/splash.png
+func fetchExtras(fcCtx *FCContext) ([]packer.File, error) {
+	extras := fcCtx.extras
+	if extras == nil {
+		return nil, nil
+	}
+
+	bucket := strings.SplitN(extras.Location, "/", 2)[0]
+	files := []packer.File{}
+	for _, o := range extras.Objects {
+		name := strings.TrimPrefix(bucket+"/"+o.Key, extras.Location)
+		if err := packer.ValidateEntryPath(name); err != nil {
+			return nil, err
+		}
+		fcCtx.Logger.Debugf("fetch extra file %s: %s", name, o.Key)
+		content, err := readObject(fcCtx, bucket+"/"+o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("fetch extra file %s: %v", name, err)
+		}
+		files = append(files, packer.File{Name: name, Content: content})
+	}
+	return files, nil
+}
+
+func readObject(fcCtx *FCContext, location string) ([]byte, error) {
+	r, err := oss.NewReader(fcCtx.OSSConfig(), location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.Client.GetObject(r.Object)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	return ioutil.ReadAll(resp)
+}
@@ -6,7 +6,9 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"strconv"
+	"repack/logger"
+	"repack/oss"
+	"repack/packer"
 	"strings"
 )
 
@@ -36,7 +38,7 @@ type FunctionMeta struct {
 	InitializationTimeout int
 }
 
-// FCContext ...
+// FCContext is the context of a request, it's parsed by the runtime
 type FCContext struct {
 	RequestID   string
 	Credentials Credentials
@@ -47,45 +49,118 @@ type FCContext struct {
 
 	SourceObject   string
 	ChannelID      string
+	ChannelPayload map[string]string
+	ChannelFile    *ChannelFile
 	NewApkFileName string
 	OSSEndpoint    string
 	WorkDir        string
-	SigFileName    string
+
+	// Source is the local source of the cli, SourceObject is read from oss
+	// if it's nil
+	Source sourceReader
+
+	// CacheDir is the dir of the footers and the work dirs, WORK_DIR_BASE
+	// if it's empty
+	CacheDir string
+	// Signer signs the footers, the key pair of CertPEM_PATH and
+	// PrivateKeyPEM_PATH if it's nil
+	Signer packer.Signer
+
+	// extras are the extra files of the channel listed by WithChannel
+	extras *channelExtras
+
+	Logger *logger.Logger
+}
+
+// cacheDir returns the dir of the footers and the work dirs
+func (ctx *FCContext) cacheDir() string {
+	if ctx.CacheDir != "" {
+		return ctx.CacheDir
+	}
+	return WORK_DIR_BASE
+}
+
+// signer returns the signer of the footers
+func (ctx *FCContext) signer() (packer.Signer, error) {
+	if ctx.Signer != nil {
+		return ctx.Signer, nil
+	}
+	return loadKeySigner(CertPEM_PATH, PrivateKeyPEM_PATH)
 }
 
-// NewFromContext ...
+// NewFromContext parses the source and the channel of req, the credentials
+// are from the runtime
 func NewFromContext(req *http.Request) (*FCContext, error) {
-	mStr := req.Header.Get(fcFunctionMemory)
-	m, err := strconv.Atoi(mStr)
+	ctx, err := newSourceContext(req, req.URL.Query().Get("src"))
 	if err != nil {
-		m = -1
+		return nil, err
 	}
-	tStr := req.Header.Get(fcFunctionTimeout)
-	t, err := strconv.Atoi(tStr)
+	payload, err := parsePayload(req.URL.Query())
 	if err != nil {
-		t = -1
+		return nil, err
 	}
-	itStr := req.Header.Get(fcInitializationTimeout)
-	it, err := strconv.Atoi(itStr)
+	return ctx.WithChannel(req.URL.Query().Get("cid"), payload)
+}
+
+// newSourceContext returns the context of req by the runtime for the source
+// object, the channel fields are left empty
+func newSourceContext(req *http.Request, sourceObject string) (*FCContext, error) {
+	if err := validateSource(sourceObject); err != nil {
+		return nil, err
+	}
+	ctx, err := serverRuntime.Context(req)
 	if err != nil {
-		it = -1
+		return nil, err
 	}
-	rid := req.Header.Get(fcRequestID)
+	ctx.SourceObject = sourceObject
+	ctx.ChannelFile = channelFileFor(sourceObject)
+	ctx.Logger = logger.With("request_id", ctx.RequestID, "src", sourceObject)
+	return ctx, nil
+}
 
-	sourceObject := req.URL.Query().Get("src")
-	channelID := req.URL.Query().Get("cid")
-	ossEndpoint := fmt.Sprintf("http://oss-%s-internal.aliyuncs.com", req.Header.Get(fcRegion))
-	bucketAndObject := strings.SplitN(sourceObject, "/", 2)
-	if len(bucketAndObject) != 2 {
-		return nil, fmt.Errorf("src = %s is invalid, the format is bucket/objectkey", sourceObject)
+// IsBundle reports whether the source is an android app bundle, the bundle
+// is signed by the jar signer like the v1 scheme of the apk
+func (ctx *FCContext) IsBundle() bool {
+	return strings.EqualFold(path.Ext(ctx.SourceKey()), packer.BundleExt)
+}
+
+// IsAPKSet reports whether the source is named as a container of the base
+// apk and its splits, it only keeps the extension of the output file name.
+// The repack detects the apk set by its content and only repacks the base.
+func (ctx *FCContext) IsAPKSet() bool {
+	ext := path.Ext(ctx.SourceKey())
+	return strings.EqualFold(ext, packer.APKSetExt) || strings.EqualFold(ext, packer.XAPKSetExt)
+}
+
+// WithChannel returns a copy of ctx for the channel and its payload fields,
+// its work dir is created if not exist
+func (ctx *FCContext) WithChannel(channelID string, payload map[string]string) (*FCContext, error) {
+	if err := validateChannel(channelID); err != nil {
+		return nil, err
+	}
+	if err := validatePayload(payload); err != nil {
+		return nil, err
 	}
-	_, objectKey := bucketAndObject[0], bucketAndObject[1]
+	objectKey := ctx.SourceKey()
 	_, fileName := filepath.Split(objectKey)
 	fileSuffix := path.Ext(fileName)
 	filenameOnly := strings.TrimSuffix(fileName, fileSuffix)
-	newApkFileName := fmt.Sprintf("%s_%s.apk", filenameOnly, channelID)
+	ext := ".apk"
+	if ctx.IsBundle() || ctx.IsAPKSet() {
+		ext = fileSuffix
+	}
+	newApkFileName := fmt.Sprintf("%s_%s%s", filenameOnly, channelID, ext)
 
-	workDir := fmt.Sprintf("/%s/%s.%s_workdir", WORK_DIR_BASE, strings.Replace(sourceObject, "/", "_", -1), channelID)
+	c := *ctx
+	c.ChannelID = channelID
+	c.ChannelPayload = payload
+	c.Logger = ctx.Logger.With("channel", channelID)
+	extras, err := listExtras(&c)
+	if err != nil {
+		return nil, err
+	}
+	c.extras = extras
+	workDir := fmt.Sprintf("/%s/%s.%s_workdir", ctx.cacheDir(), strings.Replace(ctx.SourceObject, "/", "_", -1), c.ChannelKey())
 	exist, _ := PathExists(workDir)
 	if !exist {
 		err := os.MkdirAll(workDir, os.ModePerm)
@@ -94,37 +169,45 @@ func NewFromContext(req *http.Request) (*FCContext, error) {
 		}
 	}
 
-	ctx := &FCContext{
-		RequestID: rid,
-		Credentials: Credentials{
-			AccessKeyID:     req.Header.Get(fcAccessKeyID),
-			AccessKeySecret: req.Header.Get(fcAccessKeySecret),
-			SecurityToken:   req.Header.Get(fcSecurityToken),
-		},
-		Function: FunctionMeta{
-			Name:                  req.Header.Get(fcFunctionName),
-			Handler:               req.Header.Get(fcFunctionHandler),
-			Memory:                m,
-			Timeout:               t,
-			Initializer:           req.Header.Get(fcFunctionInitializer),
-			InitializationTimeout: it,
-		},
-		Service: ServiceMeta{
-			ServiceName: req.Header.Get(fcServiceName),
-			LogProject:  req.Header.Get(fcServiceLogProject),
-			LogStore:    req.Header.Get(fcServiceLogstore),
-			Qualifier:   req.Header.Get(fcQualifier),
-			VersionID:   req.Header.Get(fcVersionID),
-		},
-		Region:    req.Header.Get(fcRegion),
-		AccountID: req.Header.Get(fcAccountID),
-
-		SourceObject:   sourceObject,
-		ChannelID:      channelID,
-		NewApkFileName: newApkFileName,
-		OSSEndpoint:    ossEndpoint,
-		WorkDir:        workDir,
-		SigFileName:    "",
+	c.NewApkFileName = newApkFileName
+	c.WorkDir = workDir
+	return &c, nil
+}
+
+// OSSConfig returns the config to access oss with the credentials of ctx
+func (ctx *FCContext) OSSConfig() oss.OSSConfig {
+	return oss.OSSConfig{
+		Endpoint:        ctx.OSSEndpoint,
+		AccessKeyID:     ctx.Credentials.AccessKeyID,
+		AccessKeySecret: ctx.Credentials.AccessKeySecret,
+		SecurityToken:   ctx.Credentials.SecurityToken,
+		Logger:          ctx.Logger,
 	}
-	return ctx, nil
+}
+
+// openSource returns the reader of the source, the local source or the
+// source object on oss
+func (ctx *FCContext) openSource() (sourceReader, error) {
+	if ctx.Source != nil {
+		return ctx.Source, nil
+	}
+	r, err := oss.NewReader(ctx.OSSConfig(), ctx.SourceObject)
+	if err != nil {
+		return nil, fmt.Errorf("oss reader: %v", err)
+	}
+	return r, nil
+}
+
+// SourceBucket returns the bucket of the source object
+func (ctx *FCContext) SourceBucket() string {
+	return strings.SplitN(ctx.SourceObject, "/", 2)[0]
+}
+
+// SourceKey returns the object key of the source object
+func (ctx *FCContext) SourceKey() string {
+	bucketAndObject := strings.SplitN(ctx.SourceObject, "/", 2)
+	if len(bucketAndObject) != 2 {
+		return ""
+	}
+	return bucketAndObject[1]
 }
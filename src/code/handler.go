@@ -1,20 +1,44 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"repack/oss"
+	"repack/logger"
+	"repack/urlsign"
 	"strconv"
 	"strings"
 )
 
-func handleError(w http.ResponseWriter, err error) {
-	w.WriteHeader(400)
-	log.Printf("handle error: %v", err)
+// handleError responds 400, or the code of the httpError in err
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	code := 400
+	var he *httpError
+	if errors.As(err, &he) {
+		code = he.Code
+	}
+	handleErrorCode(w, r, code, err)
+}
+
+func handleErrorCode(w http.ResponseWriter, r *http.Request, code int, err error) {
+	w.WriteHeader(code)
+	logger.With("request_id", serverRuntime.RequestID(r)).Errorf("handle error: %v", err)
 	fmt.Fprintf(w, "error: %v", err)
 }
 
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf)
+}
+
 func parseRange(r string) (int64, int64, error) {
 	parts := strings.Split(r, "=")
 	if len(parts) != 2 {
@@ -41,35 +65,50 @@ func parseRange(r string) (int64, int64, error) {
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		batchHandler(w, r)
+		return
+	}
+	query := r.URL.Query()
+	payload, err := parsePayload(query)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if err := verifyURL(r, query.Get("src"), urlsign.Channel(query.Get("cid"), payload)); err != nil {
+		handleErrorCode(w, r, 403, err)
+		return
+	}
 	fcCtx, err := NewFromContext(r)
-	log.Printf("fcContext=%v", fcCtx)
 	if err != nil {
-		handleError(w, fmt.Errorf("fail to NewFromContext due to  %v", err))
+		handleError(w, r, fmt.Errorf("fail to NewFromContext due to  %w", err))
 		return
 	}
 	switch r.Method {
 	case "HEAD":
 		f, res, err := repackAPK(fcCtx)
 		if err != nil {
-			handleError(w, err)
+			handleError(w, r, err)
 			return
 		}
 		defer f.Close()
 		w.Header().Set("Accept-Ranges", "bytes")
+		if res.ETag != "" {
+			w.Header().Set("ETag", res.ETag)
+		}
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", res.Offset+res.FooterSize))
 		w.WriteHeader(200)
 		return
 	case "GET":
-		log.Printf("range: %s", r.Header.Get("Range"))
+		fcCtx.Logger = fcCtx.Logger.With("range", r.Header.Get("Range"))
 		beginPos, endPos, err := parseRange(r.Header.Get("Range"))
 		if err != nil {
-			log.Printf("parse range error: %v", err)
-			handleError(w, err)
+			handleError(w, r, err)
 			return
 		}
 		f, res, err := repackAPK(fcCtx)
 		if err != nil {
-			handleError(w, err)
+			handleError(w, r, err)
 			return
 		}
 		defer f.Close()
@@ -77,6 +116,9 @@ func handler(w http.ResponseWriter, r *http.Request) {
 			endPos = res.Offset + res.FooterSize
 		}
 		w.Header().Set("Accept-Ranges", "bytes")
+		if res.ETag != "" {
+			w.Header().Set("ETag", res.ETag)
+		}
 		w.Header().Set("Cache-Control", "max-age=604800") // tell CDN to cache 7 days
 		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fcCtx.NewApkFileName))
 		w.Header().Set("Content-Type", "application/octet-stream")
@@ -85,48 +127,12 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		if endPos-beginPos < res.Offset+res.FooterSize {
 			w.WriteHeader(206)
 		}
-		// need read from oss
-		ossBegin, ossEnd := int64(-1), int64(-1)
-		if beginPos < res.Offset {
-			log.Printf("Range: %s, read oss, beginPos: %d, offset: %d", r.Header.Get("Range"), beginPos, res.Offset)
-			ossBegin = beginPos
-			ossEnd = endPos
-			if res.Offset < ossEnd {
-				ossEnd = res.Offset
-			}
-			ossReader, err := oss.NewReader(
-				oss.OSSConfig{
-					Endpoint:        fcCtx.OSSEndpoint,
-					AccessKeyID:     fcCtx.Credentials.AccessKeyID,
-					AccessKeySecret: fcCtx.Credentials.AccessKeySecret,
-					SecurityToken:   fcCtx.Credentials.SecurityToken,
-				}, fcCtx.SourceObject)
-			if err != nil {
-				handleError(w, fmt.Errorf("oss reader: %v", err))
-				return
-			}
-			err = copyData("oss", w, ossReader, ossBegin, ossEnd-ossBegin)
-			if err != nil {
-				log.Printf("copy error: %v", err)
-				handleError(w, err)
-				return
-			}
-		}
-		if endPos > res.Offset {
-			log.Printf("Range: %s, read file, endPos: %d, offset: %d", r.Header.Get("Range"), endPos, res.Offset)
-			fileBegin := int64(0)
-			if beginPos > res.Offset {
-				fileBegin = beginPos - res.Offset
-			}
-			err := copyData("file", w, f, fileBegin, endPos-res.Offset-fileBegin)
-			if err != nil {
-				log.Printf("copy error: %v", err)
-				handleError(w, err)
-				return
-			}
+		if err := copySegments(fcCtx, w, f, res, beginPos, endPos); err != nil {
+			handleError(w, r, err)
+			return
 		}
 		return
 	default:
-		handleError(w, fmt.Errorf("method %s not supported", r.Method))
+		handleError(w, r, fmt.Errorf("method %s not supported", r.Method))
 	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"repack/oss"
+	"runtime"
+	"runtime/debug"
+)
+
+// Version is set at build time: go build -ldflags "-X main.Version=v1.2.3"
+var Version = "dev"
+
+// ReadinessProbeObject is the bucket/objectkey checked by /readyz to make
+// sure oss is reachable, the check is skipped if empty
+var ReadinessProbeObject = os.Getenv("READINESS_PROBE_OBJECT")
+
+// supportedSchemes are the apk signature schemes generated
+var supportedSchemes = []string{"v1"}
+
+// supportedModes are the ways to write the channel into the apk
+var supportedModes = []string{ModeFile, ModeComment}
+
+// healthzHandler reports the process is up
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+type readyzResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyzHandler checks the instance is able to serve: the signing key is
+// loaded, the sources and the url signing are configured, the work dir is writable and the
+// storage is reachable
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := readyzResponse{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Ready = false
+			resp.Checks[name] = err.Error()
+			return
+		}
+		resp.Checks[name] = "ok"
+	}
+
+	_, err := loadKeySigner(CertPEM_PATH, PrivateKeyPEM_PATH)
+	check("signer", err)
+	check("allowlist", checkAllowlist())
+	if URLSignDisabled {
+		resp.Checks["urlsign"] = "disabled"
+	} else {
+		check("urlsign", checkURLSign())
+	}
+	check("workdir", checkWritable(WORK_DIR_BASE))
+	if ReadinessProbeObject == "" {
+		resp.Checks["storage"] = "skipped"
+	} else {
+		ctx, err := serverRuntime.Context(r)
+		if err == nil {
+			_, err = oss.NewReader(ctx.OSSConfig(), ReadinessProbeObject)
+		}
+		check("storage", err)
+	}
+
+	code := 200
+	if !resp.Ready {
+		code = 503
+	}
+	writeJSON(w, code, resp)
+}
+
+// checkWritable creates and removes a temp file in dir
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+type versionResponse struct {
+	Version        string   `json:"version"`
+	Runtime        string   `json:"runtime"`
+	GoVersion      string   `json:"goVersion"`
+	Module         string   `json:"module,omitempty"`
+	ModuleVersion  string   `json:"moduleVersion,omitempty"`
+	KeyFingerprint string   `json:"keyFingerprint,omitempty"`
+	KeyError       string   `json:"keyError,omitempty"`
+	Schemes        []string `json:"schemes"`
+	Modes          []string `json:"modes"`
+}
+
+// versionHandler reports the build info, the fingerprint of the signing
+// certificate and the supported schemes
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	resp := versionResponse{
+		Version:   Version,
+		Runtime:   serverRuntime.Name(),
+		GoVersion: runtime.Version(),
+		Schemes:   supportedSchemes,
+		Modes:     supportedModes,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		resp.Module = bi.Main.Path
+		resp.ModuleVersion = bi.Main.Version
+	}
+	if s, err := loadKeySigner(CertPEM_PATH, PrivateKeyPEM_PATH); err != nil {
+		resp.KeyError = fmt.Sprintf("%v", err)
+	} else {
+		resp.KeyFingerprint = certFingerprint(s.Cert)
+	}
+	writeJSON(w, 200, resp)
+}
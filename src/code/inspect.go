@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"repack/axml"
+	"repack/packer"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mozilla-services/pkcs7"
+	"github.com/rsc/zipmerge/zip"
+)
+
+// modes the channel is read from
+const (
+	InspectModeFile         = "file"
+	InspectModeComment      = "comment"
+	InspectModeSigningBlock = "signing_block"
+	InspectModeMetaData     = "meta_data"
+)
+
+// ChannelMetaData are the <meta-data> names of the channel of the common SDKs,
+// they are reported besides the ones of the channel files
+var ChannelMetaData = []string{"UMENG_CHANNEL", "BUGLY_APP_CHANNEL", "TD_CHANNEL_ID", "InstallChannel"}
+
+// channelPlaceholder renders the channel in the path templates to match the
+// entry names
+const channelPlaceholder = "\x00"
+
+// channelInfo is the channel read back from an apk
+type channelInfo struct {
+	Channel string `json:"channel"`
+	// Base is the entry of the base apk inspected in the apk set
+	Base string `json:"base,omitempty"`
+	// Mode is where Channel is read from, one of the InspectMode consts
+	Mode    string            `json:"mode,omitempty"`
+	Payload map[string]string `json:"payload,omitempty"`
+
+	// Files is the content of the channel files by entry name
+	Files map[string]string `json:"files,omitempty"`
+	// Comment is the eocd comment without the channel
+	Comment string `json:"comment,omitempty"`
+	// SigningBlock is the values of the apk signing block by hex id, except
+	// the signature schemes
+	SigningBlock map[string]string `json:"signing_block,omitempty"`
+	MetaData     map[string]string `json:"meta_data,omitempty"`
+
+	Signers []apkSigner `json:"signers"`
+}
+
+// apkSigner is a signer certificate of the apk
+type apkSigner struct {
+	// Scheme is v1, v2 or v3
+	Scheme      string `json:"scheme"`
+	File        string `json:"file,omitempty"`
+	Subject     string `json:"subject"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// certFingerprint returns the hex SHA-256 of the certificate
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// setChannel sets the channel read from mode unless it's already found
+func (info *channelInfo) setChannel(mode, channel string, payload map[string]string) {
+	if info.Channel != "" || channel == "" {
+		return
+	}
+	info.Channel, info.Mode, info.Payload = channel, mode, payload
+}
+
+// inspectAPK reads the channel of the apk written by any of the channel
+// files, and the signer certificates
+func inspectAPK(r io.ReaderAt, size int64, files []*ChannelFile) (*channelInfo, error) {
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("zip reader: %v", err)
+	}
+	// the apk set has no manifest of its own, its base apk is inspected
+	if packer.IsAPKSet(zipReader) {
+		base, offset, err := packer.FindBaseAPK(zipReader)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(base.CompressedSize64)
+		info, err := inspectAPK(io.NewSectionReader(r, offset, size), size, files)
+		if err != nil {
+			return nil, fmt.Errorf("inspect %s: %v", base.Name, err)
+		}
+		info.Base = base.Name
+		return info, nil
+	}
+	info := &channelInfo{Signers: []apkSigner{}}
+
+	// channel files, the channel in the comment and the signing block is
+	// preferred as it's marked explicitly
+	fileChannel, filePayload := "", map[string]string(nil)
+	bundle := false
+	for _, e := range zipReader.File {
+		bundle = bundle || e.Name == packer.BundleConfigPath
+	}
+	for _, f := range files {
+		for _, e := range zipReader.File {
+			name := e.Name
+			if bundle {
+				var ok bool
+				if name, ok = packer.APKEntryPath(e.Name); !ok {
+					continue
+				}
+			}
+			channel, ok := f.matchPath(name)
+			if !ok {
+				continue
+			}
+			content, err := readEntry(e)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %v", e.Name, err)
+			}
+			if info.Files == nil {
+				info.Files = map[string]string{}
+			}
+			info.Files[e.Name] = content
+			payload := map[string]string(nil)
+			if channel == "" {
+				channel, payload = parseChannelContent(content, f.channelKey())
+			}
+			if fileChannel == "" {
+				fileChannel, filePayload = channel, payload
+			}
+		}
+	}
+
+	// eocd comment
+	orig, content, ok := packer.SplitChannelComment(zipReader.Comment)
+	info.Comment = orig
+	if ok {
+		channel, payload := parseChannelContent(content, ChannelKeyName)
+		info.setChannel(InspectModeComment, channel, payload)
+	}
+
+	// apk signing block
+	pairs, err := packer.ReadSigningBlock(r, zipReader.AppendOffset())
+	if err != nil {
+		return nil, fmt.Errorf("signing block: %v", err)
+	}
+	ids := make([]uint32, 0, len(pairs))
+	for id := range pairs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		value := pairs[id]
+		switch id {
+		case packer.SigningBlockV2ID, packer.SigningBlockV3ID:
+			scheme := "v2"
+			if id == packer.SigningBlockV3ID {
+				scheme = "v3"
+			}
+			certs, err := packer.SigningBlockCerts(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s signature: %v", scheme, err)
+			}
+			for _, cert := range certs {
+				info.Signers = append(info.Signers, apkSigner{
+					Scheme:      scheme,
+					Subject:     cert.Subject.String(),
+					Fingerprint: certFingerprint(cert),
+				})
+			}
+			continue
+		case packer.SigningBlockWalleID, packer.SigningBlockChannelID:
+			// the channel of comment mode is in the VasDolly pair of the v2/v3
+			// signed sources, it's parsed like the comment
+			channel, payload := parseChannelContent(string(value), ChannelKeyName)
+			info.setChannel(InspectModeSigningBlock, channel, payload)
+		}
+		if info.SigningBlock == nil {
+			info.SigningBlock = map[string]string{}
+		}
+		key := fmt.Sprintf("%#08x", id)
+		if utf8.Valid(value) {
+			info.SigningBlock[key] = string(value)
+		} else {
+			info.SigningBlock[key] = hex.EncodeToString(value)
+		}
+	}
+
+	info.setChannel(InspectModeFile, fileChannel, filePayload)
+
+	// meta-data and v1 signers
+	for _, e := range zipReader.File {
+		switch {
+		case e.Name == packer.AndroidManifestPath:
+			info.MetaData = inspectMetaData(e, files)
+			for _, name := range ChannelMetaData {
+				info.setChannel(InspectModeMetaData, info.MetaData[name], nil)
+			}
+		case packer.IsSignatureFile(e.Name) && !strings.HasSuffix(strings.ToUpper(e.Name), ".SF"):
+			buf, err := readEntry(e)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %v", e.Name, err)
+			}
+			p7, err := pkcs7.Parse([]byte(buf))
+			if err != nil {
+				return nil, fmt.Errorf("parse %s: %v", e.Name, err)
+			}
+			cert := p7.GetOnlySigner()
+			if cert == nil && len(p7.Certificates) > 0 {
+				cert = p7.Certificates[0]
+			}
+			if cert != nil {
+				info.Signers = append(info.Signers, apkSigner{
+					Scheme:      "v1",
+					File:        e.Name,
+					Subject:     cert.Subject.String(),
+					Fingerprint: certFingerprint(cert),
+				})
+			}
+		}
+	}
+	return info, nil
+}
+
+// inspectMetaData returns the string values of the channel <meta-data>, the
+// errors are ignored as the manifest is not needed to read the channel
+func inspectMetaData(e *zip.File, files []*ChannelFile) map[string]string {
+	buf, err := readEntry(e)
+	if err != nil {
+		return nil
+	}
+	doc, err := axml.Parse([]byte(buf))
+	if err != nil {
+		return nil
+	}
+	all, err := doc.MetaData()
+	if err != nil {
+		return nil
+	}
+	names := append([]string{}, ChannelMetaData...)
+	for _, f := range files {
+		for name := range f.MetaData {
+			names = append(names, name)
+		}
+	}
+	res := map[string]string{}
+	for _, name := range names {
+		if v, ok := all[name]; ok && v != "" {
+			res[name] = v
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+func readEntry(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	return string(buf), err
+}
+
+// matchPath reports whether name is the channel file of f, the channel is
+// returned if it's in the path
+func (f *ChannelFile) matchPath(name string) (string, bool) {
+	if f.Mode == ModeComment {
+		return "", false
+	}
+	pattern := f.Path
+	if f.pathTmpl != nil {
+		var err error
+		if pattern, err = f.renderTemplate(f.pathTmpl, channelPlaceholder, nil); err != nil {
+			return "", false
+		}
+	}
+	i := strings.Index(pattern, channelPlaceholder)
+	if i < 0 {
+		return "", name == pattern
+	}
+	prefix, suffix := pattern[:i], strings.Replace(pattern[i+1:], channelPlaceholder, "", -1)
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	channel := name[len(prefix) : len(name)-len(suffix)]
+	return channel, validateChannel(channel) == nil
+}
+
+// channelKey returns the key of the channel id in the content
+func (f *ChannelFile) channelKey() string {
+	if f.Key == "" {
+		return ChannelKeyName
+	}
+	return f.Key
+}
+
+// parseChannelContent parses the content of a channel file: a json object,
+// a .properties file, or the bare channel id
+func parseChannelContent(content, key string) (string, map[string]string) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "{") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(content), &fields); err == nil {
+			payload := map[string]string{}
+			for k, v := range fields {
+				if s, ok := v.(string); ok {
+					payload[k] = s
+				} else {
+					buf, _ := json.Marshal(v)
+					payload[k] = string(buf)
+				}
+			}
+			channel := payload[key]
+			delete(payload, key)
+			return channel, payload
+		}
+	}
+	if !strings.ContainsAny(content, "=:\n") {
+		return content, nil
+	}
+
+	payload := parseProperties(content)
+	channel := payload[key]
+	delete(payload, key)
+	return channel, payload
+}
+
+// parseProperties parses a .properties file, the continuation lines are not
+// supported
+func parseProperties(content string) map[string]string {
+	res := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		// the first unescaped '=' or ':' separates the key and the value
+		sep := len(line)
+		for i := 0; i < len(line); i++ {
+			if line[i] == '\\' {
+				i++
+				continue
+			}
+			if line[i] == '=' || line[i] == ':' {
+				sep = i
+				break
+			}
+		}
+		key := unescapeProperty(strings.TrimSpace(line[:sep]))
+		value := ""
+		if sep < len(line) {
+			value = unescapeProperty(strings.TrimLeft(line[sep+1:], " \t"))
+		}
+		res[key] = value
+	}
+	return res
+}
+
+// unescapeProperty reverts escapeProperty
+func unescapeProperty(s string) string {
+	var b strings.Builder
+	var high rune
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 >= len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if i+4 >= len(s) {
+				b.WriteString(s[i-1:])
+				return b.String()
+			}
+			v, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				b.WriteString(s[i-1 : i+5])
+				i += 4
+				continue
+			}
+			i += 4
+			r := rune(v)
+			switch {
+			case r >= 0xd800 && r < 0xdc00:
+				high = r
+				continue
+			case r >= 0xdc00 && r < 0xe000 && high != 0:
+				r = (high-0xd800)<<10 + (r - 0xdc00) + 0x10000
+			}
+			high = 0
+			b.WriteRune(r)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// inspectCandidates returns the channel files to read the channel of src,
+// all of them if src is empty
+func inspectCandidates(src string) []*ChannelFile {
+	if src == "" {
+		return append(append([]*ChannelFile{}, ChannelFiles...), DefaultChannelFile)
+	}
+	f := channelFileFor(src)
+	if f == DefaultChannelFile {
+		return []*ChannelFile{f}
+	}
+	return []*ChannelFile{f, DefaultChannelFile}
+}
+
+// inspectHandler reports the channel and the signers of src
+func inspectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		handleError(w, r, fmt.Errorf("method %s not supported", r.Method))
+		return
+	}
+	src := r.URL.Query().Get("src")
+	if err := verifyURL(r, src, ""); err != nil {
+		handleErrorCode(w, r, 403, err)
+		return
+	}
+	fcCtx, err := newSourceContext(r, src)
+	if err != nil {
+		handleError(w, r, fmt.Errorf("fail to NewFromContext due to  %w", err))
+		return
+	}
+	info, err := inspectSource(fcCtx)
+	if err != nil {
+		handleError(w, r, err)
+		return
+	}
+	writeJSON(w, 200, info)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"repack/metrics"
+	"strconv"
+	"time"
+)
+
+var (
+	requestCounter = metrics.NewCounter(
+		"repack_http_requests_total", "HTTP requests by method and status.", "method", "status")
+	requestDuration = metrics.NewHistogram(
+		"repack_http_request_duration_seconds", "HTTP request latency by method.", metrics.DefBuckets, "method")
+	footerCounter = metrics.NewCounter(
+		"repack_footers_total", "Channel footer lookups by result: hit, generated or error.", "result")
+	generateDuration = metrics.NewHistogram(
+		"repack_generation_duration_seconds", "Time to generate a channel footer.", metrics.DefBuckets)
+	servedBytes = metrics.NewCounter(
+		"repack_served_bytes_total", "Bytes served by origin: oss or footer.", "source")
+	signDuration = metrics.NewHistogram(
+		"repack_sign_duration_seconds", "Time to sign the signature file.", metrics.DefBuckets)
+)
+
+// statusWriter records the status code written to the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(buf []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = 200
+	}
+	return sw.ResponseWriter.Write(buf)
+}
+
+// methodLabel returns the method of the known ones or "other", the label
+// values of the client methods would be unbounded
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST":
+		return method
+	}
+	return "other"
+}
+
+// instrument counts the requests served by h
+func instrument(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r)
+		if sw.status == 0 {
+			sw.status = 200
+		}
+		method := methodLabel(r.Method)
+		requestCounter.Inc(method, strconv.Itoa(sw.status))
+		requestDuration.Observe(time.Since(start).Seconds(), method)
+	}
+}
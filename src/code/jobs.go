@@ -0,0 +1,688 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"repack/logger"
+	"repack/urlsign"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// consts ...
+const (
+	JobDirName         = "jobs"
+	JobPersistInterval = 2 * time.Second
+	// JobLeaseTimeout is how long a job without heartbeat is considered
+	// abandoned by its instance and can be resumed by another one
+	JobLeaseTimeout = 2 * time.Minute
+	// JobURLTTL is the validity of the signed query of the job routes in the
+	// submit response
+	JobURLTTL = 7 * 24 * time.Hour
+	// JobRunMargin is left of the function timeout for the channels in
+	// progress, the invocation stops taking channels after the deadline
+	JobRunMargin = 15 * time.Second
+)
+
+// JobInvokeURL is the http trigger of the function, the jobs are run by its
+// async invocations on function compute
+var JobInvokeURL = os.Getenv("JOB_INVOKE_URL")
+
+// invokeClient queues the async invocations, they return once queued
+var invokeClient = &http.Client{Timeout: 10 * time.Second}
+
+// job status
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobCancelled = "cancelled"
+)
+
+var jobIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// job is a batch generation running in the background. The progress is
+// persisted in the work dir, so the job survives instance restarts and can
+// be resumed by any instance sharing the NAS.
+//
+// Function compute freezes the instance between the requests, so the job is
+// run by the async invocations of POST /jobs/{id}/run there. An invocation
+// stops before the function timeout and releases the job to the next one.
+// The other runtimes run the job in a goroutine.
+type job struct {
+	ID           string        `json:"id"`
+	SourceObject string        `json:"src"`
+	Channels     []string      `json:"channels"`
+	Concurrency  int           `json:"concurrency"`
+	Status       string        `json:"status"`
+	Owner        string        `json:"owner"`
+	Heartbeat    time.Time     `json:"heartbeat"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	FinishedAt   *time.Time    `json:"finishedAt,omitempty"`
+	Results      []batchResult `json:"results"`
+}
+
+// jobStatus is the job summary without the results
+type jobStatus struct {
+	ID           string     `json:"id"`
+	SourceObject string     `json:"src"`
+	Status       string     `json:"status"`
+	Total        int        `json:"total"`
+	Completed    int        `json:"completed"`
+	Succeeded    int        `json:"succeeded"`
+	Failed       int        `json:"failed"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	FinishedAt   *time.Time `json:"finishedAt,omitempty"`
+	// Query is the signed query of the job routes, only in the submit
+	// response if the urls are signed
+	Query string `json:"query,omitempty"`
+}
+
+func (j *job) status() jobStatus {
+	st := jobStatus{
+		ID:           j.ID,
+		SourceObject: j.SourceObject,
+		Status:       j.Status,
+		Total:        len(j.Channels),
+		CreatedAt:    j.CreatedAt,
+		FinishedAt:   j.FinishedAt,
+	}
+	for _, res := range j.Results {
+		switch res.Status {
+		case "":
+			continue
+		case "ok":
+			st.Succeeded++
+		default:
+			st.Failed++
+		}
+		st.Completed++
+	}
+	return st
+}
+
+// jobRun is a job running on this instance
+type jobRun struct {
+	mu        sync.Mutex
+	job       *job
+	cancelled int32
+	// lost is set once another instance took over the job, the run stops
+	// without saving the job again
+	lost int32
+	// deadline is the function timeout of the invocation running the job,
+	// zero if the run is not limited
+	deadline time.Time
+}
+
+// expired reports whether the run is past the deadline
+func (run *jobRun) expired() bool {
+	return !run.deadline.IsZero() && time.Now().After(run.deadline)
+}
+
+// pending returns the number of channels not generated yet
+func (j *job) pending() int {
+	n := 0
+	for _, res := range j.Results {
+		if res.Status == "" {
+			n++
+		}
+	}
+	return n
+}
+
+type jobManager struct {
+	instance string
+
+	mu      sync.Mutex
+	running map[string]*jobRun
+}
+
+var jobs = newJobManager()
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		instance: newJobID(),
+		running:  make(map[string]*jobRun),
+	}
+}
+
+func newJobID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("rand: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
+
+func (m *jobManager) dir() string {
+	return filepath.Join(WORK_DIR_BASE, JobDirName)
+}
+
+func (m *jobManager) path(id string) string {
+	return filepath.Join(m.dir(), id+".json")
+}
+
+func (m *jobManager) cancelPath(id string) string {
+	return filepath.Join(m.dir(), id+".cancel")
+}
+
+// claimPath is the lock file of taking over the job with the expired
+// heartbeat, it's created exclusively so only one instance resumes the job
+func (m *jobManager) claimPath(id string, heartbeat time.Time) string {
+	return filepath.Join(m.dir(), fmt.Sprintf("%s.%d.claim", id, heartbeat.UnixNano()))
+}
+
+// claim creates the claim file of the heartbeat, false if another instance
+// created it first
+func (m *jobManager) claim(id string, heartbeat time.Time) (bool, error) {
+	f, err := os.OpenFile(m.claimPath(id, heartbeat), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.WriteString(m.instance)
+	return true, err
+}
+
+// takeOver claims the job of the expired or released lease for owner, false
+// if another instance took it first. The claim file of the last heartbeat is
+// the lock, the job is loaded again in case the owner saved it meanwhile.
+func (m *jobManager) takeOver(j *job, owner string) (bool, error) {
+	if ok, err := m.claim(j.ID, j.Heartbeat); !ok {
+		return false, err
+	}
+	cur, err := m.load(j.ID)
+	if err != nil {
+		return false, err
+	}
+	if !cur.Heartbeat.Equal(j.Heartbeat) || cur.Owner != j.Owner {
+		return false, nil
+	}
+	j.Owner = owner
+	j.Heartbeat = time.Now()
+	return true, m.save(j)
+}
+
+// removeClaims removes the claim files of the finished job
+func (m *jobManager) removeClaims(id string) {
+	files, _ := filepath.Glob(filepath.Join(m.dir(), id+".*.claim"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+func (m *jobManager) load(id string) (*job, error) {
+	if !jobIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid job id: %s", id)
+	}
+	buf, err := ioutil.ReadFile(m.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("job %s not found", id)
+		}
+		return nil, err
+	}
+	var j job
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return nil, fmt.Errorf("job %s: %v", id, err)
+	}
+	return &j, nil
+}
+
+// save writes the job file atomically, so readers never see a partial file
+func (m *jobManager) save(j *job) error {
+	buf, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%s.tmp", m.path(j.ID), m.instance)
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path(j.ID))
+}
+
+// submit persists a new job for the batch request and starts it. On
+// function compute the job is left without owner for the async invocation.
+func (m *jobManager) submit(srcCtx *FCContext, req *batchRequest) (*job, error) {
+	if len(req.Channels) > MaxBatchChannels {
+		return nil, fmt.Errorf("too many channels: %d, max: %d", len(req.Channels), MaxBatchChannels)
+	}
+	if err := os.MkdirAll(m.dir(), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("fail to create dir: %s; err %v", m.dir(), err)
+	}
+	now := time.Now()
+	j := &job{
+		ID:           newJobID(),
+		SourceObject: req.SourceObject,
+		Channels:     req.Channels,
+		Concurrency:  req.Concurrency,
+		Status:       jobPending,
+		Owner:        m.instance,
+		Heartbeat:    now,
+		CreatedAt:    now,
+		Results:      make([]batchResult, len(req.Channels)),
+	}
+	if !serverRuntime.Background() {
+		j.Owner = ""
+	}
+	if err := m.save(j); err != nil {
+		return nil, err
+	}
+	if !serverRuntime.Background() {
+		if err := invokeJob(j.ID); err != nil {
+			os.Remove(m.path(j.ID))
+			return nil, err
+		}
+		return j, nil
+	}
+	m.start(srcCtx, j)
+	return j, nil
+}
+
+// register adds the run of j on this instance, false if it's running
+func (m *jobManager) register(j *job) (*jobRun, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.running[j.ID]; ok {
+		return nil, false
+	}
+	run := &jobRun{job: j}
+	m.running[j.ID] = run
+	return run, true
+}
+
+func (m *jobManager) start(srcCtx *FCContext, j *job) {
+	if run, ok := m.register(j); ok {
+		go m.run(srcCtx, run)
+	}
+}
+
+// invokeJob queues the async invocation of POST /jobs/{id}/run with the
+// signed query of the job
+func invokeJob(id string) error {
+	if JobInvokeURL == "" {
+		return fmt.Errorf("JOB_INVOKE_URL is not set, the jobs can't run on function compute")
+	}
+	u := strings.TrimSuffix(JobInvokeURL, "/") + "/jobs/" + id + "/run"
+	if URLSignSecret != "" {
+		u += "?" + urlsign.JobQuery([]byte(URLSignSecret), id, JobURLTTL).Encode()
+	}
+	req, err := http.NewRequest("POST", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(fcInvocationType, "Async")
+	resp, err := invokeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("invoke job %s: %v", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("invoke job %s: %s", id, resp.Status)
+	}
+	return nil
+}
+
+// invoked runs the job in the async invocation of req until the deadline of
+// the function timeout, the job is released and invoked again if channels
+// are left. The duplicate invocations of a running job return at once.
+func (m *jobManager) invoked(req *http.Request, id string) (*job, error) {
+	j, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Status != jobPending && j.Status != jobRunning {
+		return j, nil
+	}
+	if j.Owner != "" && time.Since(j.Heartbeat) < JobLeaseTimeout {
+		return j, nil
+	}
+	srcCtx, err := newSourceContext(req, j.SourceObject)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := m.takeOver(j, m.instance); !ok || err != nil {
+		return j, err
+	}
+	run, ok := m.register(j)
+	if !ok {
+		return j, nil
+	}
+	if t := srcCtx.Function.Timeout; t > 0 {
+		run.deadline = time.Now().Add(time.Duration(t)*time.Second - JobRunMargin)
+	}
+	if m.run(srcCtx, run) {
+		if err := invokeJob(id); err != nil {
+			// the polling resumes the job once the lease expires
+			srcCtx.Logger.Errorf("invoke the next run error: %v", err)
+		}
+	}
+	return j, nil
+}
+
+// resume takes over the unfinished jobs abandoned by their instances, the
+// credentials of req are used for the remaining channels. On function
+// compute the job is released and invoked again.
+func (m *jobManager) resume(req *http.Request) {
+	files, err := ioutil.ReadDir(m.dir())
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		id := strings.TrimSuffix(fi.Name(), ".json")
+		if id == fi.Name() || !jobIDPattern.MatchString(id) {
+			continue
+		}
+		m.mu.Lock()
+		_, ok := m.running[id]
+		m.mu.Unlock()
+		if ok {
+			continue
+		}
+		j, err := m.load(id)
+		if err != nil {
+			logger.With("job", id).Errorf("load job error: %v", err)
+			continue
+		}
+		if j.Status != jobPending && j.Status != jobRunning {
+			continue
+		}
+		if time.Since(j.Heartbeat) < JobLeaseTimeout {
+			continue
+		}
+		srcCtx, err := newSourceContext(req, j.SourceObject)
+		if err != nil {
+			logger.With("job", id).Errorf("resume job error: %v", err)
+			continue
+		}
+		owner := m.instance
+		if !serverRuntime.Background() {
+			owner = ""
+		}
+		lastHeartbeat, lastOwner := j.Heartbeat, j.Owner
+		if ok, err := m.takeOver(j, owner); !ok || err != nil {
+			if err != nil {
+				logger.With("job", id).Errorf("take over job error: %v", err)
+			}
+			continue
+		}
+		logger.With("job", id).Infof("resume job, last heartbeat: %v, owner: %s", lastHeartbeat, lastOwner)
+		if !serverRuntime.Background() {
+			if err := invokeJob(id); err != nil {
+				logger.With("job", id).Errorf("resume job error: %v", err)
+			}
+			continue
+		}
+		m.start(srcCtx, j)
+	}
+}
+
+// checkpoint persists the progress of run and picks up the cancellation
+// requested on other instances. The job file is loaded before the save, the
+// run stops if another instance took over the job, e.g. this instance was
+// frozen longer than JobLeaseTimeout.
+func (m *jobManager) checkpoint(run *jobRun) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	j := run.job
+	if atomic.LoadInt32(&run.lost) == 1 {
+		return
+	}
+	cur, err := m.load(j.ID)
+	if err != nil {
+		logger.With("job", j.ID).Errorf("load job error: %v", err)
+		return
+	}
+	if cur.Owner != m.instance {
+		logger.With("job", j.ID).Warnf("job taken over by %s", cur.Owner)
+		atomic.StoreInt32(&run.lost, 1)
+		atomic.StoreInt32(&run.cancelled, 1)
+		return
+	}
+	for i, res := range cur.Results {
+		if i < len(j.Results) && j.Results[i].Status == "" && res.Status != "" {
+			j.Results[i] = res
+		}
+	}
+	if exist, _ := PathExists(m.cancelPath(j.ID)); exist || cur.Status == jobCancelled {
+		atomic.StoreInt32(&run.cancelled, 1)
+	}
+	j.Heartbeat = time.Now()
+	if err := m.save(j); err != nil {
+		logger.With("job", j.ID).Errorf("save job error: %v", err)
+	}
+}
+
+// run generates the pending channels of the job, true if the run stopped at
+// the deadline and released the job with channels left
+func (m *jobManager) run(srcCtx *FCContext, run *jobRun) bool {
+	j := run.job
+	srcCtx.Logger = srcCtx.Logger.With("job", j.ID)
+	defer func() {
+		m.mu.Lock()
+		delete(m.running, j.ID)
+		m.mu.Unlock()
+	}()
+
+	run.mu.Lock()
+	j.Status = jobRunning
+	pending := make(chan int, len(j.Channels))
+	for i, res := range j.Results {
+		if res.Status == "" {
+			pending <- i
+		}
+	}
+	close(pending)
+	run.mu.Unlock()
+	m.checkpoint(run)
+	srcCtx.Logger.Infof("job running, channels: %d, pending: %d", len(j.Channels), len(pending))
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(JobPersistInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.checkpoint(run)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	req := batchRequest{Channels: j.Channels, Concurrency: j.Concurrency}
+	workers := req.workers()
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range pending {
+				if atomic.LoadInt32(&run.cancelled) == 1 {
+					return
+				}
+				res := generateFooter(srcCtx, j.Channels[idx])
+				run.mu.Lock()
+				j.Results[idx] = res
+				run.mu.Unlock()
+				// checked after the channel, so every run makes progress
+				if run.expired() {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	if atomic.LoadInt32(&run.lost) == 1 {
+		srcCtx.Logger.Infof("job lost")
+		return false
+	}
+
+	run.mu.Lock()
+	if atomic.LoadInt32(&run.cancelled) == 0 && run.expired() && j.pending() > 0 {
+		// the next invocation takes over the job without the lease timeout
+		j.Owner = ""
+		pending := j.pending()
+		run.mu.Unlock()
+		m.checkpoint(run)
+		srcCtx.Logger.Infof("job released at the deadline, pending: %d", pending)
+		return true
+	}
+	j.Status = jobDone
+	if atomic.LoadInt32(&run.cancelled) == 1 {
+		j.Status = jobCancelled
+	}
+	now := time.Now()
+	j.FinishedAt = &now
+	run.mu.Unlock()
+	m.checkpoint(run)
+	m.removeClaims(j.ID)
+	srcCtx.Logger.Infof("job %s", j.Status)
+	return false
+}
+
+// cancel stops the job, the running instance notices the cancel file at the
+// next checkpoint if it is another one. The returned job is cancelled, the
+// saved one is once the run stops.
+func (m *jobManager) cancel(id string) (*job, error) {
+	j, err := m.load(id)
+	if err != nil {
+		return nil, err
+	}
+	if j.Status == jobDone || j.Status == jobCancelled {
+		return j, nil
+	}
+	if err := ioutil.WriteFile(m.cancelPath(id), []byte(time.Now().String()), 0644); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	run, ok := m.running[id]
+	m.mu.Unlock()
+	if ok {
+		atomic.StoreInt32(&run.cancelled, 1)
+		m.checkpoint(run)
+	} else if time.Since(j.Heartbeat) >= JobLeaseTimeout {
+		// nobody is running the job
+		now := time.Now()
+		j.Status = jobCancelled
+		j.FinishedAt = &now
+		if err := m.save(j); err != nil {
+			return nil, err
+		}
+		m.removeClaims(id)
+	}
+	j.Status = jobCancelled
+	return j, nil
+}
+
+// jobsHandler serves the jobs api:
+//
+//	POST /jobs                 submit a batch request, returns the job id
+//	GET  /jobs/{id}            job status
+//	GET  /jobs/{id}/results    per channel results
+//	POST /jobs/{id}/cancel     cancel the job
+//	POST /jobs/{id}/run        run the job, the async invocation of itself
+//
+// The submit signs the source and the channels like the batch requests, the
+// routes of a job sign its id, the signed query is in the submit response.
+// The abandoned jobs are resumed only for the verified requests.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/"), "/")
+	id, action := parts[0], ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var req batchRequest
+	if id == "" && r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			handleError(w, r, fmt.Errorf("invalid batch request: %v", err))
+			return
+		}
+		if err := verifyURL(r, req.SourceObject, urlsign.Batch(urlsign.ActionJobs, req.Channels, nil)); err != nil {
+			handleErrorCode(w, r, 403, err)
+			return
+		}
+	} else if err := verifyURL(r, "", urlsign.Job(id)); err != nil {
+		handleErrorCode(w, r, 403, err)
+		return
+	}
+	jobs.resume(r)
+
+	switch {
+	case id == "" && r.Method == "POST":
+		req.Channels = dedupChannels(req.Channels)
+		if len(req.Channels) == 0 {
+			handleError(w, r, fmt.Errorf("no channel to generate"))
+			return
+		}
+		srcCtx, err := newSourceContext(r, req.SourceObject)
+		if err != nil {
+			handleError(w, r, fmt.Errorf("fail to NewFromContext due to  %w", err))
+			return
+		}
+		j, err := jobs.submit(srcCtx, &req)
+		if err != nil {
+			handleError(w, r, fmt.Errorf("submit job: %v", err))
+			return
+		}
+		st := j.status()
+		if URLSignSecret != "" {
+			st.Query = urlsign.JobQuery([]byte(URLSignSecret), j.ID, JobURLTTL).Encode()
+		}
+		writeJSON(w, 202, st)
+	case id != "" && action == "" && r.Method == "GET":
+		j, err := jobs.load(id)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		writeJSON(w, 200, j.status())
+	case id != "" && action == "results" && r.Method == "GET":
+		j, err := jobs.load(id)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		results := []batchResult{}
+		for _, res := range j.Results {
+			if res.Status != "" {
+				results = append(results, res)
+			}
+		}
+		writeJSON(w, 200, results)
+	case id != "" && action == "run" && r.Method == "POST":
+		j, err := jobs.invoked(r, id)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		writeJSON(w, 200, j.status())
+	case id != "" && action == "cancel" && r.Method == "POST":
+		j, err := jobs.cancel(id)
+		if err != nil {
+			handleError(w, r, err)
+			return
+		}
+		writeJSON(w, 200, j.status())
+	default:
+		handleError(w, r, fmt.Errorf("%s %s not supported", r.Method, r.URL.Path))
+	}
+}
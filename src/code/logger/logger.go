@@ -0,0 +1,156 @@
+// Package logger writes leveled logs as JSON lines, each tagged with the
+// fields of its logger, e.g. the request id, source and channel.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level ...
+type Level int
+
+// levels ...
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the level name, info if unknown
+func ParseLevel(s string) Level {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i)
+		}
+	}
+	return InfoLevel
+}
+
+var (
+	mu    sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = ParseLevel(os.Getenv("LOG_LEVEL"))
+)
+
+// SetOutput sets the destination of all loggers
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// SetLevel sets the minimum level written by all loggers
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// Logger writes logs with its fields, a nil Logger writes without fields
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a logger with the key value pairs
+func With(kv ...interface{}) *Logger {
+	var l *Logger
+	return l.With(kv...)
+}
+
+// With returns a copy of l with the key value pairs appended
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if len(kv)%2 != 0 {
+		kv = append(kv, "")
+	}
+	var fields []interface{}
+	if l != nil {
+		fields = append(fields, l.fields...)
+	}
+	return &Logger{fields: append(fields, kv...)}
+}
+
+// Debugf ...
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.output(DebugLevel, format, args...)
+}
+
+// Infof ...
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.output(InfoLevel, format, args...)
+}
+
+// Warnf ...
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.output(WarnLevel, format, args...)
+}
+
+// Errorf ...
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.output(ErrorLevel, format, args...)
+}
+
+// Debugf logs without fields
+func Debugf(format string, args ...interface{}) { (*Logger)(nil).output(DebugLevel, format, args...) }
+
+// Infof logs without fields
+func Infof(format string, args ...interface{}) { (*Logger)(nil).output(InfoLevel, format, args...) }
+
+// Warnf logs without fields
+func Warnf(format string, args ...interface{}) { (*Logger)(nil).output(WarnLevel, format, args...) }
+
+// Errorf logs without fields
+func Errorf(format string, args ...interface{}) { (*Logger)(nil).output(ErrorLevel, format, args...) }
+
+func (l *Logger) output(lv Level, format string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if lv < level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeValue(&buf, time.Now().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeValue(&buf, lv.String())
+	buf.WriteString(`,"msg":`)
+	writeValue(&buf, fmt.Sprintf(format, args...))
+	if l != nil {
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			buf.WriteByte(',')
+			writeValue(&buf, fmt.Sprint(l.fields[i]))
+			buf.WriteByte(':')
+			writeValue(&buf, l.fields[i+1])
+		}
+	}
+	buf.WriteString("}\n")
+	out.Write(buf.Bytes())
+}
+
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,264 @@
+// Package manifest parses, edits and writes the jar manifest format of
+// META-INF/MANIFEST.MF and the .SF signature files. The sections which are
+// not edited keep their raw bytes, so their digests in the .SF are kept.
+package manifest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// LineWidth is the max bytes of a line without the line break, the longer
+// headers are continued on the next lines starting with a space
+const LineWidth = 72
+
+// NameAttribute starts the entry sections
+const NameAttribute = "Name"
+
+// Attribute is a header of a section
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// Section is the main section or an entry section of the manifest
+type Section struct {
+	Attributes []Attribute
+
+	// raw is the bytes of the parsed section with the empty line after it,
+	// it's nil once the section is edited
+	raw     []byte
+	newline string
+}
+
+// Manifest is the main section and the entry sections
+type Manifest struct {
+	Main     *Section
+	Sections []*Section
+
+	// newline is the line break of the parsed manifest, the edited sections
+	// are written with it
+	newline string
+}
+
+// New returns an empty manifest with CRLF line breaks
+func New() *Manifest {
+	m := &Manifest{newline: "\r\n"}
+	m.Main = &Section{newline: m.newline}
+	return m
+}
+
+// Parse parses the manifest, the lines end with CRLF, LF or CR
+func Parse(b []byte) (*Manifest, error) {
+	m := New()
+	if i := bytes.IndexAny(b, "\r\n"); i >= 0 {
+		m.newline = "\n"
+		if b[i] == '\r' {
+			m.newline = "\r"
+			if i+1 < len(b) && b[i+1] == '\n' {
+				m.newline = "\r\n"
+			}
+		}
+	}
+
+	var s *Section
+	start := 0
+	for len(b) > 0 {
+		line, n := nextLine(b)
+		raw := b[:n]
+		b = b[n:]
+
+		if len(line) == 0 {
+			// the empty line ends the section, the extra ones are dropped
+			if s != nil {
+				s.raw = append(s.raw, raw...)
+				if err := m.add(s); err != nil {
+					return nil, err
+				}
+				s = nil
+			}
+			start += n
+			continue
+		}
+		if s == nil {
+			s = &Section{newline: m.newline}
+		}
+		s.raw = append(s.raw, raw...)
+
+		if line[0] == ' ' {
+			if len(s.Attributes) == 0 {
+				return nil, fmt.Errorf("continuation line without header at %d", start)
+			}
+			s.Attributes[len(s.Attributes)-1].Value += string(line[1:])
+		} else {
+			i := bytes.Index(line, []byte(": "))
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid header at %d: %q", start, line)
+			}
+			s.Attributes = append(s.Attributes, Attribute{Name: string(line[:i]), Value: string(line[i+2:])})
+		}
+		start += n
+	}
+	if s != nil {
+		// the last section is ended so sections can be added after it
+		if !endsWithNewline(s.raw) {
+			s.raw = append(s.raw, m.newline...)
+		}
+		s.raw = append(s.raw, m.newline...)
+		if err := m.add(s); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// nextLine returns the first line of b without the line break, and the
+// length of the line with the line break
+func nextLine(b []byte) ([]byte, int) {
+	i := bytes.IndexAny(b, "\r\n")
+	if i < 0 {
+		return b, len(b)
+	}
+	if b[i] == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+		return b[:i], i + 2
+	}
+	return b[:i], i + 1
+}
+
+func endsWithNewline(b []byte) bool {
+	return len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r')
+}
+
+// add adds the parsed section, the first one is the main section
+func (m *Manifest) add(s *Section) error {
+	if len(m.Main.Attributes) == 0 && len(m.Sections) == 0 && s.Get(NameAttribute) == "" {
+		m.Main = s
+		return nil
+	}
+	if s.Get(NameAttribute) == "" {
+		return fmt.Errorf("section without %s: %q", NameAttribute, s.raw)
+	}
+	m.Sections = append(m.Sections, s)
+	return nil
+}
+
+// Section returns the entry section of name, it's nil if not found
+func (m *Manifest) Section(name string) *Section {
+	for _, s := range m.Sections {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// AddSection returns the entry section of name, the section is appended if
+// not found
+func (m *Manifest) AddSection(name string) *Section {
+	if s := m.Section(name); s != nil {
+		return s
+	}
+	s := &Section{newline: m.newline}
+	s.Set(NameAttribute, name)
+	m.Sections = append(m.Sections, s)
+	return s
+}
+
+// RemoveSection removes the entry section of name
+func (m *Manifest) RemoveSection(name string) {
+	sections := m.Sections[:0]
+	for _, s := range m.Sections {
+		if s.Name() != name {
+			sections = append(sections, s)
+		}
+	}
+	m.Sections = sections
+}
+
+// Bytes returns the manifest, the main section and the entry sections each
+// end with an empty line
+func (m *Manifest) Bytes() []byte {
+	var b bytes.Buffer
+	b.Write(m.Main.Bytes())
+	for _, s := range m.Sections {
+		b.Write(s.Bytes())
+	}
+	return b.Bytes()
+}
+
+// Name returns the entry name of the section, it's empty for the main section
+func (s *Section) Name() string {
+	return s.Get(NameAttribute)
+}
+
+// Get returns the value of the attribute, the names are case insensitive
+func (s *Section) Get(name string) string {
+	for _, a := range s.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Set sets the value of the attribute, it's appended if not found
+func (s *Section) Set(name, value string) {
+	s.raw = nil
+	for i, a := range s.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			s.Attributes[i].Value = value
+			return
+		}
+	}
+	s.Attributes = append(s.Attributes, Attribute{Name: name, Value: value})
+}
+
+// Delete removes the attribute
+func (s *Section) Delete(name string) {
+	attrs := s.Attributes[:0]
+	for _, a := range s.Attributes {
+		if !strings.EqualFold(a.Name, name) {
+			attrs = append(attrs, a)
+		}
+	}
+	if len(attrs) != len(s.Attributes) {
+		s.raw = nil
+	}
+	s.Attributes = attrs
+}
+
+// Bytes returns the section with the empty line after it, the raw bytes are
+// returned if it's not edited
+func (s *Section) Bytes() []byte {
+	if s.raw != nil {
+		return s.raw
+	}
+	var b bytes.Buffer
+	for _, a := range s.Attributes {
+		b.WriteString(wrapLine(a.Name, a.Value, s.newline))
+	}
+	b.WriteString(s.newline)
+	return b.Bytes()
+}
+
+// wrapLine returns the header wrapped at LineWidth bytes. The lines are not
+// broken inside an utf-8 character.
+func wrapLine(name, value, newline string) string {
+	line := name + ": " + value
+	var b strings.Builder
+	for width := LineWidth; len(line) > width; width = LineWidth - 1 {
+		n := width
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		if n == 0 {
+			n = width
+		}
+		b.WriteString(line[:n] + newline + " ")
+		line = line[n:]
+	}
+	b.WriteString(line + newline)
+	return b.String()
+}
@@ -0,0 +1,259 @@
+package manifest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// signedManifest has the layout of the MANIFEST.MF of apksigner: the
+// "Created-By: 1.0 (Android)" main section, the sorted SHA-256 entry sections
+// and CRLF lines split at 70 bytes regardless of the utf-8 characters
+const signedManifest = "testdata/MANIFEST.MF"
+
+const sample = "Manifest-Version: 1.0\r\n" +
+	"Created-By: 1.0 (Android)\r\n" +
+	"\r\n" +
+	"Name: classes.dex\r\n" +
+	"SHA-256-Digest: pOtl7gA7ZU/B/L5+bBQli39Y1rXyvXe6uKBUciQS9tE=\r\n" +
+	"\r\n" +
+	"Name: res/drawable-xxxhdpi-v4/abc_btn_switch_to_on_mtrl_00012_very_lon\r\n" +
+	" g_resource_name.9.png\r\n" +
+	"SHA1-Digest: 3w8uT/MzYq2fEb7bJm2Cr2CXQbA=\r\n" +
+	"SHA-256-Digest: Nj3iDoeClVaIkNCFQDnLnCgweSjItgjXQ5+zah+pBlM=\r\n" +
+	"\r\n"
+
+func TestParseLineEndings(t *testing.T) {
+	cases := []struct {
+		name    string
+		newline string
+	}{
+		{"CRLF", "\r\n"},
+		{"LF", "\n"},
+		{"CR", "\r"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := []byte(strings.Replace(sample, "\r\n", c.newline, -1))
+			m, err := Parse(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.Main.Get("Created-By"); got != "1.0 (Android)" {
+				t.Errorf("Created-By = %q", got)
+			}
+			if len(m.Sections) != 2 {
+				t.Fatalf("sections: %d, want 2", len(m.Sections))
+			}
+			name := "res/drawable-xxxhdpi-v4/abc_btn_switch_to_on_mtrl_00012_very_long_resource_name.9.png"
+			if got := m.Sections[1].Name(); got != name {
+				t.Errorf("name = %q, want %q", got, name)
+			}
+			if !bytes.Equal(m.Bytes(), b) {
+				t.Errorf("Bytes() = %q, want %q", m.Bytes(), b)
+			}
+
+			// the edited sections are written with the line break of the
+			// manifest
+			m.AddSection("assets/dap.properties").Set("SHA-256-Digest", "x")
+			want := string(b) + "Name: assets/dap.properties" + c.newline +
+				"SHA-256-Digest: x" + c.newline + c.newline
+			if got := string(m.Bytes()); got != want {
+				t.Errorf("Bytes() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestWrapLine(t *testing.T) {
+	// the header is "Name: " followed by the value
+	cases := []struct {
+		name  string
+		value string
+		lines []int
+	}{
+		{"short", "classes.dex", []int{17}},
+		{"72 bytes", strings.Repeat("a", 66), []int{72}},
+		{"73 bytes", strings.Repeat("a", 67), []int{72, 2}},
+		{"71 bytes continued", strings.Repeat("a", 66+71), []int{72, 72}},
+		{"72 bytes continued", strings.Repeat("a", 66+72), []int{72, 72, 2}},
+		// the rune at bytes 71-73 is moved to the next line
+		{"multibyte at the first break", strings.Repeat("a", 65) + "中文", []int{71, 7}},
+		// the rune ends at byte 72, it's kept on the first line
+		{"multibyte before the first break", strings.Repeat("a", 63) + "中文", []int{72, 4}},
+		{"multibyte at the second break", strings.Repeat("a", 66+69) + "中文", []int{72, 70, 7}},
+		{"multibyte only", strings.Repeat("中", 50), []int{72, 70, 16}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			wrapped := wrapLine(NameAttribute, c.value, "\r\n")
+			if !strings.HasSuffix(wrapped, "\r\n") {
+				t.Fatalf("missing line break: %q", wrapped)
+			}
+			lines := strings.Split(strings.TrimSuffix(wrapped, "\r\n"), "\r\n")
+			if len(lines) != len(c.lines) {
+				t.Fatalf("lines: %q, want lengths %v", lines, c.lines)
+			}
+			for i, l := range lines {
+				if len(l) != c.lines[i] {
+					t.Errorf("line %d: %d bytes, want %d", i, len(l), c.lines[i])
+				}
+				if !utf8.ValidString(l) {
+					t.Errorf("line %d is broken inside a character: %q", i, l)
+				}
+				if i > 0 && l[0] != ' ' {
+					t.Errorf("line %d doesn't start with a space", i)
+				}
+			}
+
+			m, err := Parse([]byte(wrapped + "\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Section(c.value) == nil {
+				t.Errorf("section %q not found", c.value)
+			}
+		})
+	}
+}
+
+func TestParseSections(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		wantErr  string
+		main     []Attribute
+		sections [][]Attribute
+	}{
+		{
+			name:  "multi attribute",
+			input: "Manifest-Version: 1.0\nX-Android-APK-Signed: 2, 3\n\nName: a\nSHA1-Digest: 1\nSHA-256-Digest: 2\nX-Extra: 3\n\n",
+			main:  []Attribute{{"Manifest-Version", "1.0"}, {"X-Android-APK-Signed", "2, 3"}},
+			sections: [][]Attribute{
+				{{"Name", "a"}, {"SHA1-Digest", "1"}, {"SHA-256-Digest", "2"}, {"X-Extra", "3"}},
+			},
+		},
+		{
+			name:  "no main section",
+			input: "Name: a\nSHA-256-Digest: 1\n\nName: b\nSHA-256-Digest: 2\n\n",
+			sections: [][]Attribute{
+				{{"Name", "a"}, {"SHA-256-Digest", "1"}},
+				{{"Name", "b"}, {"SHA-256-Digest", "2"}},
+			},
+		},
+		{
+			name:     "extra empty lines",
+			input:    "Manifest-Version: 1.0\n\n\n\nName: a\nSHA-256-Digest: 1\n\n\n",
+			main:     []Attribute{{"Manifest-Version", "1.0"}},
+			sections: [][]Attribute{{{"Name", "a"}, {"SHA-256-Digest", "1"}}},
+		},
+		{
+			name:     "no trailing newline",
+			input:    "Manifest-Version: 1.0\n\nName: a\nSHA-256-Digest: 1",
+			main:     []Attribute{{"Manifest-Version", "1.0"}},
+			sections: [][]Attribute{{{"Name", "a"}, {"SHA-256-Digest", "1"}}},
+		},
+		{
+			name:    "unnamed section",
+			input:   "Manifest-Version: 1.0\n\nSHA-256-Digest: 1\n\n",
+			wantErr: "section without Name",
+		},
+		{
+			name:    "continuation without header",
+			input:   " continued\n\n",
+			wantErr: "continuation line without header",
+		},
+		{
+			name:    "invalid header",
+			input:   "Manifest-Version 1.0\n\n",
+			wantErr: "invalid header",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := Parse([]byte(c.input))
+			if c.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+					t.Fatalf("Parse() = %v, want %q", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkAttributes(t, "main", m.Main.Attributes, c.main)
+			if len(m.Sections) != len(c.sections) {
+				t.Fatalf("sections: %d, want %d", len(m.Sections), len(c.sections))
+			}
+			for i, s := range m.Sections {
+				checkAttributes(t, s.Name(), s.Attributes, c.sections[i])
+			}
+		})
+	}
+}
+
+func checkAttributes(t *testing.T, section string, got, want []Attribute) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: attributes %v, want %v", section, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: attribute %d = %v, want %v", section, i, got[i], want[i])
+		}
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	b, err := ioutil.ReadFile(signedManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Bytes(), b) {
+		t.Fatalf("Bytes() differs from the parsed manifest")
+	}
+	if len(m.Sections) != 9 {
+		t.Fatalf("sections: %d, want 9", len(m.Sections))
+	}
+
+	// the lines split inside a character are joined before decoding
+	name := "assets/渠道/中文文件名称测试用的一个很长的路径名称渠道.txt"
+	s := m.Section(name)
+	if s == nil {
+		t.Fatalf("section %s not found", name)
+	}
+	if got := s.Get("sha-256-digest"); got != "aJbjCPVpLZ7bZR3KKj9xgcbmIeTP1ZVH06HvyUnAe0E=" {
+		t.Errorf("digest = %q", got)
+	}
+
+	// only the edited section is written again, with the line width of this
+	// package
+	s.Set("SHA-256-Digest", "x")
+	m.RemoveSection("classes.dex")
+	edited, err := Parse(m.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edited.Sections) != 8 {
+		t.Fatalf("sections: %d, want 8", len(edited.Sections))
+	}
+	for i, es := range edited.Sections {
+		if es.Name() == name {
+			if es.Get("SHA-256-Digest") != "x" {
+				t.Errorf("digest = %q, want x", es.Get("SHA-256-Digest"))
+			}
+			continue
+		}
+		orig := m.Sections[i]
+		if !bytes.Equal(es.Bytes(), orig.Bytes()) || !bytes.Contains(b, orig.Bytes()) {
+			t.Errorf("section %s is changed", es.Name())
+		}
+	}
+}
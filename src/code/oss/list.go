@@ -0,0 +1,51 @@
+package oss
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// ListPageSize is the max keys of a list request
+const ListPageSize = 100
+
+// List returns the objects under the prefix of location, bucket/prefix, the
+// keys ending with "/" are skipped. An error is returned if there are more
+// than limit objects.
+func List(config OSSConfig, location string, limit int) ([]oss.ObjectProperties, error) {
+	client, err := getOSSClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketAndPrefix := strings.SplitN(location, "/", 2)
+	if len(bucketAndPrefix) != 2 {
+		return nil, fmt.Errorf("Invalid location: %s", location)
+	}
+	bucket, prefix := bucketAndPrefix[0], bucketAndPrefix[1]
+	bucketClient, _ := client.Bucket(bucket)
+	store := NewStoreWithRetry(bucketClient, config.Logger)
+
+	objects := []oss.ObjectProperties{}
+	marker := ""
+	for {
+		res, err := store.ListObjects(oss.Prefix(prefix), oss.Marker(marker), oss.MaxKeys(ListPageSize))
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range res.Objects {
+			if strings.HasSuffix(o.Key, "/") {
+				continue
+			}
+			if len(objects) >= limit {
+				return nil, fmt.Errorf("more than %d objects in %s", limit, location)
+			}
+			objects = append(objects, o)
+		}
+		if !res.IsTruncated {
+			return objects, nil
+		}
+		marker = res.NextMarker
+	}
+}
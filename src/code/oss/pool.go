@@ -0,0 +1,85 @@
+package oss
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// ClientIdleTimeout is how long an unused client stays in the pool
+const ClientIdleTimeout = 15 * time.Minute
+
+type poolKey struct {
+	endpoint    string
+	accessKeyID string
+}
+
+type poolEntry struct {
+	client          *oss.Client
+	accessKeySecret string
+	securityToken   string
+	lastUsed        time.Time
+}
+
+// clientPool caches oss clients by endpoint and access key. An entry is
+// rebuilt when the secret or the STS token of its access key changes, and
+// dropped once it has not been used for idleTimeout.
+type clientPool struct {
+	mu          sync.Mutex
+	entries     map[poolKey]*poolEntry
+	idleTimeout time.Duration
+}
+
+func newClientPool(idleTimeout time.Duration) *clientPool {
+	return &clientPool{
+		entries:     make(map[poolKey]*poolEntry),
+		idleTimeout: idleTimeout,
+	}
+}
+
+func (p *clientPool) get(config OSSConfig) (*oss.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	p.evict(now)
+
+	key := poolKey{
+		endpoint:    config.Endpoint,
+		accessKeyID: config.AccessKeyID,
+	}
+	if e, ok := p.entries[key]; ok {
+		if e.accessKeySecret == config.AccessKeySecret &&
+			e.securityToken == config.SecurityToken {
+			e.lastUsed = now
+			return e.client, nil
+		}
+		config.Logger.Infof("credentials changed, refresh oss client: %s", config.Endpoint)
+		delete(p.entries, key)
+	}
+
+	client, err := oss.New(
+		config.Endpoint, config.AccessKeyID, config.AccessKeySecret,
+		oss.SecurityToken(config.SecurityToken))
+	if err != nil {
+		return nil, err
+	}
+	p.entries[key] = &poolEntry{
+		client:          client,
+		accessKeySecret: config.AccessKeySecret,
+		securityToken:   config.SecurityToken,
+		lastUsed:        now,
+	}
+
+	return client, nil
+}
+
+// evict drops the entries idle for longer than p.idleTimeout, p.mu must be held
+func (p *clientPool) evict(now time.Time) {
+	for key, e := range p.entries {
+		if now.Sub(e.lastUsed) > p.idleTimeout {
+			delete(p.entries, key)
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package oss
 
 import (
+	"encoding/xml"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"repack/logger"
+	"repack/metrics"
 	"strings"
 	"time"
 
@@ -22,17 +25,26 @@ type Store interface {
 		partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error)
 	CompleteMultipartUpload(imur oss.InitiateMultipartUploadResult,
 		parts []oss.UploadPart) (oss.CompleteMultipartUploadResult, error)
+	AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) error
+	// ListUploadedParts lists a page of the parts after partNumberMarker
+	ListUploadedParts(imur oss.InitiateMultipartUploadResult, partNumberMarker int) (oss.ListUploadedPartsResult, error)
+	ListObjects(options ...oss.Option) (oss.ListObjectsResult, error)
 }
 
+var retryCounter = metrics.NewCounter(
+	"repack_oss_retries_total", "OSS requests retried after a 503 response.")
+
 // StoreWithRetry ...
 type StoreWithRetry struct {
 	ossBucket *oss.Bucket
+	log       *logger.Logger
 }
 
 // NewStoreWithRetry ...
-func NewStoreWithRetry(ossBucket *oss.Bucket) Store {
+func NewStoreWithRetry(ossBucket *oss.Bucket, log *logger.Logger) Store {
 	return &StoreWithRetry{
 		ossBucket: ossBucket,
+		log:       log,
 	}
 }
 
@@ -68,18 +80,20 @@ func (s *StoreWithRetry) retry(f func() error) error {
 			return nil
 		}
 
-		log.Printf("retry error: %s", err.Error())
+		s.log.Warnf("retry error: %s", err.Error())
 		if se, ok := err.(oss.ServiceError); ok && se.StatusCode == 503 {
 			delay := b.next()
 			if delay == time.Duration(0) {
 				return err
 			}
+			retryCounter.Inc()
 			time.Sleep(delay)
 		} else if strings.Contains(err.Error(), "503") {
 			delay := b.next()
 			if delay == time.Duration(0) {
 				return err
 			}
+			retryCounter.Inc()
 			time.Sleep(delay)
 		} else {
 			return err
@@ -171,3 +185,51 @@ func (s *StoreWithRetry) CompleteMultipartUpload(imur oss.InitiateMultipartUploa
 
 	return
 }
+
+// AbortMultipartUpload ...
+func (s *StoreWithRetry) AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) (err error) {
+	s.retry(func() error {
+		err = s.ossBucket.AbortMultipartUpload(imur)
+		return err
+	})
+
+	return
+}
+
+// ListUploadedParts ...
+func (s *StoreWithRetry) ListUploadedParts(
+	imur oss.InitiateMultipartUploadResult, partNumberMarker int) (resp oss.ListUploadedPartsResult, err error) {
+	s.retry(func() error {
+		resp, err = listUploadedParts(s.ossBucket, imur, partNumberMarker)
+		return err
+	})
+
+	return
+}
+
+// listUploadedParts is Bucket.ListUploadedParts with the part-number-marker,
+// the sdk has no option of it, the request is sent by the raw Conn.Do
+func listUploadedParts(bucket *oss.Bucket, imur oss.InitiateMultipartUploadResult,
+	partNumberMarker int) (oss.ListUploadedPartsResult, error) {
+	var out oss.ListUploadedPartsResult
+	subResource := "uploadId=" + imur.UploadID
+	params := fmt.Sprintf("%s&max-parts=%d&part-number-marker=%d", subResource, MaxListParts, partNumberMarker)
+	resp, err := bucket.Client.Conn.Do("GET", bucket.BucketName, imur.Key, params, subResource, nil, nil, 0, nil)
+	if err != nil {
+		return out, err
+	}
+	defer resp.Body.Close()
+
+	err = xml.NewDecoder(resp.Body).Decode(&out)
+	return out, err
+}
+
+// ListObjects ...
+func (s *StoreWithRetry) ListObjects(options ...oss.Option) (resp oss.ListObjectsResult, err error) {
+	s.retry(func() error {
+		resp, err = s.ossBucket.ListObjects(options...)
+		return err
+	})
+
+	return
+}
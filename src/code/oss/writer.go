@@ -0,0 +1,469 @@
+package oss
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"repack/logger"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+// consts ...
+const (
+	CopyPartWorkerCount   = 8
+	CopyPartSizeInBytes   = 50 * 1024 * 1024
+	MaxWriteBufferInBytes = 100 * 1024 * 1024
+	MinPartSizeInBytes    = 100 * 1024
+	MaxPartSizeInBytes    = 5 * 1024 * 1024 * 1024
+	MaxWorkerCount        = 32
+	// MaxListParts is the page size of listing the uploaded parts
+	MaxListParts = 1000
+)
+
+// Writer implements io.Writer and writes to OSS object, the content is
+// the first offset bytes of the source object followed by the written data
+type Writer struct {
+	Bucket    string
+	Object    string
+	SrcBucket string
+	SrcObject string
+	Client    Store
+
+	// PartSize is the size of the copied and uploaded parts
+	PartSize int64
+	// WorkerCount is the number of parts transferred in parallel
+	WorkerCount int
+	// CheckpointFile keeps the upload id, if set, a Flush failed with a
+	// retryable error doesn't abort the multipart upload and the next Flush
+	// resumes it. It should be unique per target object.
+	CheckpointFile string
+
+	srcClient Store
+	log       *logger.Logger
+	buffer    []byte
+	spill     *os.File
+	size      int64
+	offset    int64
+}
+
+// NewWriter ...
+func NewWriter(config OSSConfig, location, srcLocation string, offset int64) (*Writer, error) {
+	client, err := getOSSClient(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bucketAndObject := strings.SplitN(location, "/", 2)
+	if len(bucketAndObject) != 2 {
+		return nil, fmt.Errorf("Invalid location: %s", location)
+	}
+
+	bucket, object := bucketAndObject[0], bucketAndObject[1]
+	bucketClient, _ := client.Bucket(bucket)
+
+	bucketAndObject = strings.SplitN(srcLocation, "/", 2)
+	if len(bucketAndObject) != 2 {
+		return nil, fmt.Errorf("Invalid location: %s", srcLocation)
+	}
+	srcBucket, srcObject := bucketAndObject[0], bucketAndObject[1]
+	srcBucketClient, _ := client.Bucket(srcBucket)
+
+	return &Writer{
+		Bucket:      bucket,
+		Object:      object,
+		SrcBucket:   srcBucket,
+		SrcObject:   srcObject,
+		Client:      NewStoreWithRetry(bucketClient, config.Logger),
+		PartSize:    CopyPartSizeInBytes,
+		WorkerCount: CopyPartWorkerCount,
+		srcClient:   NewStoreWithRetry(srcBucketClient, config.Logger),
+		log:         config.Logger,
+		offset:      offset,
+	}, nil
+}
+
+// Write buffers the data in memory, it is moved to a temp file once
+// MaxWriteBufferInBytes is exceeded
+func (w *Writer) Write(buf []byte) (int, error) {
+	if w.spill == nil && len(w.buffer)+len(buf) > MaxWriteBufferInBytes {
+		f, err := ioutil.TempFile("", "oss-writer-")
+		if err != nil {
+			return 0, err
+		}
+		w.log.Warnf("max writer buffer exceeded, spill to %s", f.Name())
+		if _, err := f.Write(w.buffer); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		w.spill = f
+		w.buffer = nil
+	}
+
+	if w.spill != nil {
+		n, err := w.spill.Write(buf)
+		w.size += int64(n)
+		return n, err
+	}
+	w.buffer = append(w.buffer, buf...)
+	w.size += int64(len(buf))
+	return len(buf), nil
+}
+
+// Close removes the temp file of the written data
+func (w *Writer) Close() error {
+	if w.spill == nil {
+		return nil
+	}
+	w.spill.Close()
+	err := os.Remove(w.spill.Name())
+	w.spill = nil
+	return err
+}
+
+// written returns the data written to w
+func (w *Writer) written() io.ReaderAt {
+	if w.spill != nil {
+		return w.spill
+	}
+	return bytes.NewReader(w.buffer)
+}
+
+// writerPart is a part of the target object, it is either copied from the
+// source object at start or uploaded from the written data at start
+type writerPart struct {
+	number int
+	start  int64
+	size   int64
+	copy   bool
+}
+
+// parts splits the target object into parts of w.PartSize, the last part of
+// the source is merged into the previous one if smaller than MinPartSizeInBytes
+func (w *Writer) parts() []writerPart {
+	parts := []writerPart{}
+	for start := int64(0); start < w.offset; {
+		size := w.PartSize
+		if w.offset-start-size < MinPartSizeInBytes {
+			size = w.offset - start
+		}
+		parts = append(parts, writerPart{start: start, size: size, copy: true})
+		start += size
+	}
+	for start := int64(0); start < w.size; start += w.PartSize {
+		size := w.PartSize
+		if start+size > w.size {
+			size = w.size - start
+		}
+		parts = append(parts, writerPart{start: start, size: size})
+	}
+	for i := range parts {
+		parts[i].number = i + 1
+	}
+	return parts
+}
+
+type writerCheckpoint struct {
+	Bucket    string
+	Object    string
+	SrcBucket string
+	SrcObject string
+	Offset    int64
+	Size      int64
+	PartSize  int64
+	UploadID  string
+}
+
+func (w *Writer) checkpoint(uploadID string) writerCheckpoint {
+	return writerCheckpoint{
+		Bucket:    w.Bucket,
+		Object:    w.Object,
+		SrcBucket: w.SrcBucket,
+		SrcObject: w.SrcObject,
+		Offset:    w.offset,
+		Size:      w.size,
+		PartSize:  w.PartSize,
+		UploadID:  uploadID,
+	}
+}
+
+// resume returns the multipart upload in the checkpoint file and its parts
+// already uploaded, ok is false if there is nothing to resume
+func (w *Writer) resume() (up oss.InitiateMultipartUploadResult, done map[int]oss.UploadPart, ok bool) {
+	if w.CheckpointFile == "" {
+		return
+	}
+	buf, err := ioutil.ReadFile(w.CheckpointFile)
+	if err != nil {
+		return
+	}
+	var cp writerCheckpoint
+	if err := json.Unmarshal(buf, &cp); err != nil {
+		w.log.Warnf("invalid checkpoint %s: %v", w.CheckpointFile, err)
+		return
+	}
+	if cp != w.checkpoint(cp.UploadID) {
+		w.log.Warnf("checkpoint %s mismatch, discard upload: %s", w.CheckpointFile, cp.UploadID)
+		if cp.Bucket == w.Bucket && cp.UploadID != "" {
+			// the discarded parts are billed until aborted
+			w.abort(oss.InitiateMultipartUploadResult{
+				Bucket:   cp.Bucket,
+				Key:      cp.Object,
+				UploadID: cp.UploadID,
+			})
+		}
+		os.Remove(w.CheckpointFile)
+		return
+	}
+
+	up = oss.InitiateMultipartUploadResult{
+		Bucket:   w.Bucket,
+		Key:      w.Object,
+		UploadID: cp.UploadID,
+	}
+	uploaded, err := w.listParts(up)
+	if err != nil {
+		w.log.Warnf("list parts of upload %s: %v", cp.UploadID, err)
+		if !isRetryable(err) {
+			w.abort(up)
+			os.Remove(w.CheckpointFile)
+		}
+		return
+	}
+
+	sizes := map[int]int64{}
+	for _, p := range w.parts() {
+		sizes[p.number] = p.size
+	}
+	done = map[int]oss.UploadPart{}
+	for _, p := range uploaded {
+		if sizes[p.PartNumber] == int64(p.Size) {
+			done[p.PartNumber] = oss.UploadPart{PartNumber: p.PartNumber, ETag: p.ETag}
+		}
+	}
+	w.log.Infof("resume upload %s, parts done: %d", cp.UploadID, len(done))
+	return up, done, true
+}
+
+// listParts returns all parts of the upload, a page has up to 1000 parts
+func (w *Writer) listParts(up oss.InitiateMultipartUploadResult) ([]oss.UploadedPart, error) {
+	parts := []oss.UploadedPart{}
+	marker := 0
+	for {
+		res, err := w.Client.ListUploadedParts(up, marker)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, res.UploadedParts...)
+		if !res.IsTruncated {
+			return parts, nil
+		}
+		next, err := strconv.Atoi(res.NextPartNumberMarker)
+		if err != nil || next <= marker {
+			return nil, fmt.Errorf("invalid next part number marker: %q", res.NextPartNumberMarker)
+		}
+		marker = next
+	}
+}
+
+// isRetryable is false for the client errors of oss, e.g. the upload doesn't
+// exist or the access is denied, a later Flush would fail the same way
+func isRetryable(err error) bool {
+	var se oss.ServiceError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == 408 || se.StatusCode == 429
+	}
+	return true
+}
+
+func (w *Writer) saveCheckpoint(uploadID string) error {
+	if w.CheckpointFile == "" {
+		return nil
+	}
+	buf, err := json.Marshal(w.checkpoint(uploadID))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(w.CheckpointFile, buf, 0644)
+}
+
+// Flush writes the target object:
+// 1. initiate a multipart upload, or resume the one in w.CheckpointFile
+// 2. copy the content before w.offset to the target
+// 3. upload the written data
+// 4. complete the multipart upload with the parts in order
+// The upload is aborted on failure unless w.CheckpointFile is set and the
+// error is retryable.
+func (w *Writer) Flush() error {
+	if w.PartSize < MinPartSizeInBytes || w.PartSize > MaxPartSizeInBytes {
+		return fmt.Errorf("part size %d is out of [%d, %d]", w.PartSize, MinPartSizeInBytes, MaxPartSizeInBytes)
+	}
+
+	// don't use multipart if the size is too small
+	if w.offset < MinPartSizeInBytes {
+		w.log.Infof("small object: %d", w.offset)
+
+		resp, err := w.srcClient.GetObject(w.SrcObject, oss.Range(0, w.offset-1))
+		if err != nil {
+			return err
+		}
+		defer resp.Close()
+		buf, err := ioutil.ReadAll(resp)
+		if err != nil {
+			return err
+		}
+		content := &concatReaderAt{
+			first:     bytes.NewReader(buf),
+			firstSize: int64(len(buf)),
+			second:    w.written(),
+		}
+		return w.Client.PutObject(
+			w.Object, io.NewSectionReader(content, 0, int64(len(buf))+w.size))
+	}
+
+	w.log.Infof("begin multipart copy, size: %d, footer: %d", w.offset, w.size)
+
+	up, done, ok := w.resume()
+	if !ok {
+		var err error
+		up, err = w.Client.InitiateMultipartUpload(w.Object)
+		if err != nil {
+			return err
+		}
+		done = map[int]oss.UploadPart{}
+		if err := w.saveCheckpoint(up.UploadID); err != nil {
+			w.abort(up)
+			return err
+		}
+	}
+
+	parts, err := w.transfer(up, done)
+	if err == nil {
+		_, err = w.Client.CompleteMultipartUpload(up, parts)
+	}
+	if err != nil {
+		if w.CheckpointFile != "" && isRetryable(err) {
+			w.log.Infof("upload %s failed, keep it to resume: %v", up.UploadID, err)
+			return err
+		}
+		w.abort(up)
+		if w.CheckpointFile != "" {
+			os.Remove(w.CheckpointFile)
+		}
+		return err
+	}
+	if w.CheckpointFile != "" {
+		os.Remove(w.CheckpointFile)
+	}
+	return nil
+}
+
+func (w *Writer) abort(up oss.InitiateMultipartUploadResult) {
+	if err := w.Client.AbortMultipartUpload(up); err != nil {
+		w.log.Errorf("abort upload %s: %v", up.UploadID, err)
+	}
+}
+
+// transfer copies and uploads the parts not in done in parallel, and
+// returns all parts sorted by part number
+func (w *Writer) transfer(up oss.InitiateMultipartUploadResult,
+	done map[int]oss.UploadPart) ([]oss.UploadPart, error) {
+	all := w.parts()
+	partsChan := make(chan writerPart, len(all))
+	for _, p := range all {
+		if _, ok := done[p.number]; !ok {
+			partsChan <- p
+		}
+	}
+	close(partsChan)
+
+	workers := w.WorkerCount
+	if workers <= 0 {
+		workers = CopyPartWorkerCount
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	written := w.written()
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range partsChan {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					return
+				}
+
+				var part oss.UploadPart
+				var err error
+				if p.copy {
+					part, err = w.Client.UploadPartCopy(
+						up, w.SrcBucket, w.SrcObject, p.start, p.size, p.number)
+				} else {
+					part, err = w.Client.UploadPart(
+						up, io.NewSectionReader(written, p.start, p.size), p.size, p.number)
+				}
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("part %d: %w", p.number, err)
+				}
+				if err == nil {
+					done[p.number] = part
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	parts := make([]oss.UploadPart, 0, len(done))
+	for _, part := range done {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// concatReaderAt reads first followed by second
+type concatReaderAt struct {
+	first     io.ReaderAt
+	firstSize int64
+	second    io.ReaderAt
+}
+
+func (c *concatReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	if off >= c.firstSize {
+		return c.second.ReadAt(buf, off-c.firstSize)
+	}
+	n, err := c.first.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	if n == len(buf) {
+		return n, nil
+	}
+	m, err := c.second.ReadAt(buf[n:], 0)
+	return n + m, err
+}
@@ -0,0 +1,455 @@
+package oss
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"repack/logger"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+)
+
+func init() {
+	logger.SetOutput(ioutil.Discard)
+}
+
+// fakePart is an uploaded part, the copied parts keep the source range
+type fakePart struct {
+	data       []byte
+	copyStart  int64
+	size       int64
+	copied     bool
+	lastUpload time.Time
+}
+
+// fakeStore keeps the multipart uploads in memory, the parts finish in a
+// random order
+type fakeStore struct {
+	mu        sync.Mutex
+	nextID    int
+	uploads   map[string]map[int]*fakePart
+	aborted   []string
+	completed map[string][]oss.UploadPart
+	// failPart fails the upload of the part number with the error once
+	failPart map[int]error
+	// pageSize is the page size of ListUploadedParts
+	pageSize int
+	listed   int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		uploads:   map[string]map[int]*fakePart{},
+		completed: map[string][]oss.UploadPart{},
+		failPart:  map[int]error{},
+		pageSize:  2,
+	}
+}
+
+var errNotImplemented = errors.New("not implemented")
+
+func (s *fakeStore) GetObject(objectKey string, options ...oss.Option) (io.ReadCloser, error) {
+	return nil, errNotImplemented
+}
+
+func (s *fakeStore) GetObjectDetailedMeta(objectKey string, options ...oss.Option) (http.Header, error) {
+	return nil, errNotImplemented
+}
+
+func (s *fakeStore) PutObject(objectKey string, reader io.Reader, options ...oss.Option) error {
+	return errNotImplemented
+}
+
+func (s *fakeStore) ListObjects(options ...oss.Option) (oss.ListObjectsResult, error) {
+	return oss.ListObjectsResult{}, errNotImplemented
+}
+
+func (s *fakeStore) InitiateMultipartUpload(objectKey string, options ...oss.Option) (oss.InitiateMultipartUploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = map[int]*fakePart{}
+	return oss.InitiateMultipartUploadResult{Key: objectKey, UploadID: id}, nil
+}
+
+func (s *fakeStore) addPart(imur oss.InitiateMultipartUploadResult, number int, part *fakePart) (oss.UploadPart, error) {
+	time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failPart[number]; err != nil {
+		delete(s.failPart, number)
+		return oss.UploadPart{}, err
+	}
+	parts, ok := s.uploads[imur.UploadID]
+	if !ok {
+		return oss.UploadPart{}, oss.ServiceError{StatusCode: 404, Code: "NoSuchUpload"}
+	}
+	part.lastUpload = time.Now()
+	parts[number] = part
+	return oss.UploadPart{PartNumber: number, ETag: fmt.Sprintf("%s-%d", imur.UploadID, number)}, nil
+}
+
+func (s *fakeStore) UploadPartCopy(imur oss.InitiateMultipartUploadResult, srcBucketName, srcObjectKey string,
+	startPosition, partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error) {
+	return s.addPart(imur, partNumber, &fakePart{copyStart: startPosition, size: partSize, copied: true})
+}
+
+func (s *fakeStore) UploadPart(imur oss.InitiateMultipartUploadResult, reader io.Reader,
+	partSize int64, partNumber int, options ...oss.Option) (oss.UploadPart, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return oss.UploadPart{}, err
+	}
+	return s.addPart(imur, partNumber, &fakePart{data: data, size: int64(len(data))})
+}
+
+func (s *fakeStore) CompleteMultipartUpload(imur oss.InitiateMultipartUploadResult,
+	parts []oss.UploadPart) (oss.CompleteMultipartUploadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[imur.UploadID]; !ok {
+		return oss.CompleteMultipartUploadResult{}, oss.ServiceError{StatusCode: 404, Code: "NoSuchUpload"}
+	}
+	s.completed[imur.UploadID] = parts
+	return oss.CompleteMultipartUploadResult{}, nil
+}
+
+func (s *fakeStore) AbortMultipartUpload(imur oss.InitiateMultipartUploadResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.uploads, imur.UploadID)
+	s.aborted = append(s.aborted, imur.UploadID)
+	return nil
+}
+
+func (s *fakeStore) ListUploadedParts(imur oss.InitiateMultipartUploadResult,
+	partNumberMarker int) (oss.ListUploadedPartsResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed++
+	parts, ok := s.uploads[imur.UploadID]
+	if !ok {
+		return oss.ListUploadedPartsResult{}, oss.ServiceError{StatusCode: 404, Code: "NoSuchUpload"}
+	}
+	numbers := []int{}
+	for n := range parts {
+		if n > partNumberMarker {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	res := oss.ListUploadedPartsResult{UploadID: imur.UploadID}
+	if len(numbers) > s.pageSize {
+		numbers = numbers[:s.pageSize]
+		res.IsTruncated = true
+		res.NextPartNumberMarker = strconv.Itoa(numbers[len(numbers)-1])
+	}
+	for _, n := range numbers {
+		res.UploadedParts = append(res.UploadedParts, oss.UploadedPart{
+			PartNumber: n,
+			ETag:       fmt.Sprintf("%s-%d", imur.UploadID, n),
+			Size:       int(parts[n].size),
+		})
+	}
+	return res, nil
+}
+
+// testOffset is the size copied from the source, the last copied part is
+// merged as the rest is less than MinPartSizeInBytes
+const testOffset = 3*MinPartSizeInBytes + MinPartSizeInBytes/2
+
+func newTestWriter(store *fakeStore, checkpoint string) *Writer {
+	return &Writer{
+		Bucket:         "bucket",
+		Object:         "channels/app_xiaomi.apk",
+		SrcBucket:      "bucket",
+		SrcObject:      "app.apk",
+		Client:         store,
+		PartSize:       MinPartSizeInBytes,
+		WorkerCount:    4,
+		CheckpointFile: checkpoint,
+		log:            logger.With("test", "writer"),
+		offset:         testOffset,
+	}
+}
+
+// testFooter returns the written data of n bytes
+func testFooter(n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(buf)
+	return buf
+}
+
+// checkCompleted checks the parts of the completed upload are in order and
+// make up the source prefix and the footer
+func checkCompleted(t *testing.T, store *fakeStore, footer []byte) {
+	t.Helper()
+	if len(store.completed) != 1 {
+		t.Fatalf("completed uploads: %d, want 1", len(store.completed))
+	}
+	for id, parts := range store.completed {
+		var copied int64
+		var uploaded []byte
+		for i, p := range parts {
+			if p.PartNumber != i+1 {
+				t.Fatalf("part %d has number %d", i, p.PartNumber)
+			}
+			if p.ETag != fmt.Sprintf("%s-%d", id, p.PartNumber) {
+				t.Errorf("part %d etag %s", p.PartNumber, p.ETag)
+			}
+			fp := store.uploads[id][p.PartNumber]
+			if fp.copied {
+				if len(uploaded) > 0 || fp.copyStart != copied {
+					t.Fatalf("part %d copies %d, want %d", p.PartNumber, fp.copyStart, copied)
+				}
+				copied += fp.size
+			} else {
+				uploaded = append(uploaded, fp.data...)
+			}
+		}
+		if copied != testOffset {
+			t.Errorf("copied %d, want %d", copied, testOffset)
+		}
+		if !bytes.Equal(uploaded, footer) {
+			t.Errorf("uploaded %d bytes differ from the footer of %d bytes", len(uploaded), len(footer))
+		}
+	}
+}
+
+func TestWriterParts(t *testing.T) {
+	cases := []struct {
+		name   string
+		offset int64
+		size   int64
+		sizes  []int64
+	}{
+		{"merged copy", testOffset, 250 * 1024, []int64{100 * 1024, 100 * 1024, 150 * 1024, 100 * 1024, 100 * 1024, 50 * 1024}},
+		{"exact copy", 2 * MinPartSizeInBytes, 10, []int64{100 * 1024, 100 * 1024, 10}},
+		{"no footer", 2*MinPartSizeInBytes + 1, 0, []int64{100 * 1024, 100*1024 + 1}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := &Writer{PartSize: MinPartSizeInBytes, offset: c.offset, size: c.size}
+			parts := w.parts()
+			if len(parts) != len(c.sizes) {
+				t.Fatalf("parts: %v, want sizes %v", parts, c.sizes)
+			}
+			for i, p := range parts {
+				if p.number != i+1 || p.size != c.sizes[i] {
+					t.Errorf("part %d: %+v, want size %d", i, p, c.sizes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		store := newFakeStore()
+		w := newTestWriter(store, "")
+		footer := testFooter(250 * 1024)
+		w.Write(footer[:1000])
+		w.Write(footer[1000:])
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		checkCompleted(t, store, footer)
+		if len(store.aborted) != 0 {
+			t.Errorf("aborted: %v", store.aborted)
+		}
+	}
+}
+
+func TestWriterAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name       string
+		checkpoint bool
+		err        error
+		aborted    bool
+	}{
+		{"denied", false, oss.ServiceError{StatusCode: 403, Code: "AccessDenied"}, true},
+		{"denied with checkpoint", true, oss.ServiceError{StatusCode: 403, Code: "AccessDenied"}, true},
+		{"unavailable", false, oss.ServiceError{StatusCode: 503}, true},
+		{"unavailable with checkpoint", true, oss.ServiceError{StatusCode: 503}, false},
+		{"network with checkpoint", true, errors.New("connection reset"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := newFakeStore()
+			store.failPart[5] = c.err
+			checkpoint := ""
+			if c.checkpoint {
+				checkpoint = filepath.Join(dir, c.name+".checkpoint")
+			}
+			w := newTestWriter(store, checkpoint)
+			w.Write(testFooter(250 * 1024))
+			err := w.Flush()
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Flush() = %v, want %v", err, c.err)
+			}
+			if got := len(store.aborted) == 1; got != c.aborted {
+				t.Errorf("aborted: %v, want %v", store.aborted, c.aborted)
+			}
+			if c.checkpoint {
+				exist, _ := pathExists(checkpoint)
+				if exist == c.aborted {
+					t.Errorf("checkpoint exists: %v", exist)
+				}
+			}
+			if len(store.completed) != 0 {
+				t.Errorf("completed: %v", store.completed)
+			}
+		})
+	}
+}
+
+func TestWriterResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "publish.checkpoint")
+	footer := testFooter(250 * 1024)
+
+	store := newFakeStore()
+	store.failPart[5] = oss.ServiceError{StatusCode: 503}
+	w := newTestWriter(store, checkpoint)
+	w.Write(footer)
+	if err := w.Flush(); err == nil {
+		t.Fatal("Flush() = nil, want the error of part 5")
+	}
+	first := map[int]time.Time{}
+	for n, p := range store.uploads["upload-1"] {
+		first[n] = p.lastUpload
+	}
+
+	// the next flush lists the parts page by page and uploads the rest
+	w = newTestWriter(store, checkpoint)
+	w.Write(footer)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.completed["upload-1"]; !ok {
+		t.Fatalf("upload-1 is not resumed, completed: %v", store.completed)
+	}
+	checkCompleted(t, store, footer)
+	if store.listed < 2 {
+		t.Errorf("listed %d pages, want all of them", store.listed)
+	}
+	for n, p := range store.uploads["upload-1"] {
+		if at, ok := first[n]; ok && !at.Equal(p.lastUpload) {
+			t.Errorf("part %d is uploaded again", n)
+		}
+	}
+	if exist, _ := pathExists(checkpoint); exist {
+		t.Errorf("checkpoint is not removed")
+	}
+}
+
+func TestWriterResumeMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "publish.checkpoint")
+
+	store := newFakeStore()
+	store.failPart[5] = oss.ServiceError{StatusCode: 503}
+	w := newTestWriter(store, checkpoint)
+	w.Write(testFooter(250 * 1024))
+	if err := w.Flush(); err == nil {
+		t.Fatal("Flush() = nil, want the error of part 5")
+	}
+
+	// another footer size doesn't match the checkpoint, the upload is
+	// discarded and a new one is started
+	footer := testFooter(200 * 1024)
+	w = newTestWriter(store, checkpoint)
+	w.Write(footer)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.aborted) != 1 || store.aborted[0] != "upload-1" {
+		t.Errorf("aborted: %v, want upload-1", store.aborted)
+	}
+	if _, ok := store.completed["upload-2"]; !ok {
+		t.Fatalf("upload-2 is not completed: %v", store.completed)
+	}
+	checkCompleted(t, store, footer)
+}
+
+func TestWriterSpill(t *testing.T) {
+	store := newFakeStore()
+	w := newTestWriter(store, "")
+	w.PartSize = 16 * 1024 * 1024
+	chunk := testFooter(1024 * 1024)
+	var footer []byte
+	for i := 0; int64(len(footer)) <= MaxWriteBufferInBytes; i++ {
+		chunk[0] = byte(i)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		footer = append(footer, chunk...)
+	}
+	if w.spill == nil {
+		t.Fatal("the written data is not spilled to a temp file")
+	}
+	if w.buffer != nil {
+		t.Errorf("buffer is kept: %d bytes", len(w.buffer))
+	}
+	name := w.spill.Name()
+	got := make([]byte, len(footer))
+	if _, err := w.written().ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, footer) {
+		t.Fatal("the spilled data differs from the written data")
+	}
+
+	w.offset = w.PartSize
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, parts := range store.completed {
+		if len(parts) != 1+(len(footer)+int(w.PartSize)-1)/int(w.PartSize) {
+			t.Errorf("parts: %d", len(parts))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := pathExists(name); exist {
+		t.Errorf("temp file %s is not removed", name)
+	}
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,408 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// consts of the split apk set sources
+const (
+	APKSetExt  = ".apks"
+	XAPKSetExt = ".xapk"
+	// XAPKManifestPath lists the split apks of the xapk
+	XAPKManifestPath = "manifest.json"
+
+	fileHeaderSignature      = 0x04034b50
+	directoryHeaderSignature = 0x02014b50
+	directory64EndSignature  = 0x06064b50
+	directory64LocSignature  = 0x07064b50
+	directory64EndLength     = 56
+	zip64ExtraID             = 0x0001
+	zip64Version             = 45
+	maxUint16                = 1<<16 - 1
+	maxUint32                = 1<<32 - 1
+)
+
+// apkSetBasePaths are the base apk in the apks of bundletool, in the order of
+// preference
+var apkSetBasePaths = []string{"splits/base-master.apk", "universal.apk", "base.apk"}
+
+// IsAPKSet reports whether the entries are of an apk set, it has apks but no
+// manifest of its own
+func IsAPKSet(zipReader *zip.Reader) bool {
+	apks := false
+	for _, e := range zipReader.File {
+		if e.Name == AndroidManifestPath || e.Name == BundleConfigPath {
+			return false
+		}
+		apks = apks || strings.EqualFold(path.Ext(e.Name), ".apk")
+	}
+	return apks
+}
+
+// FindBaseAPK returns the entry of the base apk in the apk set and the offset
+// of its data, the base apk must be stored to be read in place
+func FindBaseAPK(zipReader *zip.Reader) (*zip.File, int64, error) {
+	entries := map[string]*zip.File{}
+	for _, e := range zipReader.File {
+		entries[e.Name] = e
+	}
+	names := apkSetBasePaths
+	if e, ok := entries[XAPKManifestPath]; ok {
+		name, err := xapkBasePath(e)
+		if err != nil {
+			return nil, 0, fmt.Errorf("read %s: %v", XAPKManifestPath, err)
+		}
+		if name != "" {
+			names = append([]string{name}, apkSetBasePaths...)
+		}
+	}
+
+	var base *zip.File
+	for _, name := range names {
+		if e, ok := entries[name]; ok {
+			base = e
+			break
+		}
+	}
+	// the only apk in the root other than the config splits, e.g.
+	// com.example.app.apk of the xapk
+	if base == nil {
+		for _, e := range zipReader.File {
+			if strings.Contains(e.Name, "/") || !strings.EqualFold(path.Ext(e.Name), ".apk") ||
+				strings.HasPrefix(e.Name, "config.") {
+				continue
+			}
+			if base != nil {
+				return nil, 0, fmt.Errorf("multiple base apks: %s, %s", base.Name, e.Name)
+			}
+			base = e
+		}
+	}
+	if base == nil {
+		return nil, 0, fmt.Errorf("base apk not found")
+	}
+
+	if base.Method != zip.Store || base.CompressedSize64 != base.UncompressedSize64 {
+		return nil, 0, fmt.Errorf("base apk %s is compressed, it must be stored", base.Name)
+	}
+	if base.Flags&0x1 != 0 {
+		return nil, 0, fmt.Errorf("base apk %s is encrypted", base.Name)
+	}
+	offset, err := base.DataOffset()
+	if err != nil {
+		return nil, 0, fmt.Errorf("base apk %s: %v", base.Name, err)
+	}
+	return base, offset, nil
+}
+
+// xapkBasePath returns the file of the base split in the xapk manifest, it's
+// empty if the manifest lists no splits
+func xapkBasePath(e *zip.File) (string, error) {
+	content, err := readEntry(e)
+	if err != nil {
+		return "", err
+	}
+	var manifest struct {
+		SplitAPKs []struct {
+			File string `json:"file"`
+			ID   string `json:"id"`
+		} `json:"split_apks"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", err
+	}
+	for _, s := range manifest.SplitAPKs {
+		if s.ID == "base" {
+			return s.File, nil
+		}
+	}
+	return "", nil
+}
+
+// repackAPKSet repacks the base apk of the apk set, the base apk is replaced
+// in place and the entries after it are shifted. The footer is
+//
+//	[local header of the base apk][footer of the base apk][central directory]
+//
+// and the segments lay out the apk set with the source, the splits are kept
+// as is.
+func (p *Packer) repackAPKSet(ctx context.Context, src io.ReaderAt, zipReader *zip.Reader, ch *Channel) (*Footer, error) {
+	base, dataOffset, err := FindBaseAPK(zipReader)
+	if err != nil {
+		return nil, err
+	}
+	headerOffset, baseSize := base.HeaderOffset(), int64(base.CompressedSize64)
+	p.Logger.Infof("base apk: %s, offset: %d, size: %d", base.Name, dataOffset, baseSize)
+
+	// the local header is patched after the footer of the base apk as its
+	// crc is known then, the name and the extra are kept so the length is not
+	// changed
+	header := make([]byte, dataOffset-headerOffset)
+	if _, err := src.ReadAt(header, headerOffset); err != nil {
+		return nil, fmt.Errorf("read local header: %v", err)
+	}
+	if binary.LittleEndian.Uint32(header) != fileHeaderSignature {
+		return nil, fmt.Errorf("invalid local header of %s", base.Name)
+	}
+	baseSrc := io.NewSectionReader(src, dataOffset, baseSize)
+	baseReader, err := zip.NewReader(baseSrc, baseSize)
+	if err != nil {
+		return nil, fmt.Errorf("zip reader of %s: %v", base.Name, err)
+	}
+	buf := &bytes.Buffer{}
+	buf.Write(header)
+	appendOffset, err := p.repackZip(ctx, buf, baseSrc, baseSize, baseReader, ch)
+	if err != nil {
+		return nil, err
+	}
+	footerSize := int64(buf.Len() - len(header))
+
+	prefixCRC, err := p.prefixCRC(src, dataOffset, appendOffset)
+	if err != nil {
+		return nil, fmt.Errorf("base apk crc: %v", err)
+	}
+	size := appendOffset + footerSize
+	crc := crc32Combine(prefixCRC, crc32.ChecksumIEEE(buf.Bytes()[len(header):]), footerSize)
+	if size >= maxUint32 {
+		return nil, fmt.Errorf("base apk is too large: %d", size)
+	}
+	header = buf.Bytes()[:len(header)]
+	binary.LittleEndian.PutUint16(header[6:], base.Flags&^0x8)
+	binary.LittleEndian.PutUint32(header[14:], crc)
+	binary.LittleEndian.PutUint32(header[18:], uint32(size))
+	binary.LittleEndian.PutUint32(header[22:], uint32(size))
+
+	// the base apk ends at the next entry, its data descriptor is dropped
+	dirOffset := zipReader.AppendOffset()
+	end := dirOffset
+	for _, e := range zipReader.File {
+		if o := e.HeaderOffset(); o > headerOffset && o < end {
+			end = o
+		}
+	}
+	shift := int64(len(header)) + size - (end - headerOffset)
+	dirSize, err := writeDirectory(buf, zipReader, base, crc, size, shift)
+	if err != nil {
+		return nil, fmt.Errorf("write central directory: %v", err)
+	}
+	p.Logger.Infof("base apk crc: %08x, size: %d, shift: %d", crc, size, shift)
+
+	return &Footer{
+		Data: buf.Bytes(),
+		Segments: []Segment{
+			{Offset: 0, Size: headerOffset},
+			{Footer: true, Offset: 0, Size: int64(len(header))},
+			{Offset: dataOffset, Size: appendOffset},
+			{Footer: true, Offset: int64(len(header)), Size: footerSize},
+			{Offset: end, Size: dirOffset - end},
+			{Footer: true, Offset: int64(len(header)) + footerSize, Size: dirSize},
+		},
+	}, nil
+}
+
+// directoryHeader is the central directory header without the name, the
+// extra and the comment
+type directoryHeader struct {
+	Signature        uint32
+	CreatorVersion   uint16
+	ReaderVersion    uint16
+	Flags            uint16
+	Method           uint16
+	ModifiedTime     uint16
+	ModifiedDate     uint16
+	CRC32            uint32
+	CompressedSize   uint32
+	UncompressedSize uint32
+	NameLength       uint16
+	ExtraLength      uint16
+	CommentLength    uint16
+	DiskNumber       uint16
+	InternalAttrs    uint16
+	ExternalAttrs    uint32
+	Offset           uint32
+}
+
+// directoryEnd is the end of central directory record without the comment
+type directoryEnd struct {
+	Signature     uint32
+	DiskNumber    uint16
+	DirDiskNumber uint16
+	DirRecords    uint16
+	TotalRecords  uint16
+	Size          uint32
+	Offset        uint32
+	CommentLength uint16
+}
+
+// directory64End is the zip64 end of central directory record followed by
+// its locator
+type directory64End struct {
+	Signature      uint32
+	RecordSize     uint64
+	CreatorVersion uint16
+	ReaderVersion  uint16
+	DiskNumber     uint32
+	DirDiskNumber  uint32
+	DirRecords     uint64
+	TotalRecords   uint64
+	Size           uint64
+	Offset         uint64
+
+	LocatorSignature uint32
+	EndDiskNumber    uint32
+	EndOffset        uint64
+	TotalDisks       uint32
+}
+
+// writeDirectory writes the central directory of the apk set with the new
+// base apk, the entries after the base apk are shifted. The zip64 records
+// are written if the sizes or the offsets exceed 4GB, e.g. with the obb
+// files of the xapk.
+func writeDirectory(w io.Writer, zipReader *zip.Reader, base *zip.File, crc uint32, size, shift int64) (int64, error) {
+	buf := &bytes.Buffer{}
+	for _, e := range zipReader.File {
+		offset := e.HeaderOffset()
+		if offset > base.HeaderOffset() {
+			offset += shift
+		}
+		h := directoryHeader{
+			Signature:      directoryHeaderSignature,
+			CreatorVersion: e.CreatorVersion,
+			ReaderVersion:  e.ReaderVersion,
+			Flags:          e.Flags,
+			Method:         e.Method,
+			ModifiedTime:   e.ModifiedTime,
+			ModifiedDate:   e.ModifiedDate,
+			CRC32:          e.CRC32,
+			ExternalAttrs:  e.ExternalAttrs,
+		}
+		compressedSize, uncompressedSize := e.CompressedSize64, e.UncompressedSize64
+		if e == base {
+			h.Flags &^= 0x8
+			h.CRC32 = crc
+			compressedSize, uncompressedSize = uint64(size), uint64(size)
+		}
+		extra := zip.StripZip64Extra(e.Extra)
+		if compressedSize >= maxUint32 || uncompressedSize >= maxUint32 || offset >= maxUint32 {
+			// the sizes and the offset are in the zip64 extra
+			h.CompressedSize, h.UncompressedSize, h.Offset = maxUint32, maxUint32, maxUint32
+			if h.ReaderVersion < zip64Version {
+				h.ReaderVersion = zip64Version
+			}
+			var zip64 [28]byte
+			binary.LittleEndian.PutUint16(zip64[0:], zip64ExtraID)
+			binary.LittleEndian.PutUint16(zip64[2:], 24)
+			binary.LittleEndian.PutUint64(zip64[4:], uncompressedSize)
+			binary.LittleEndian.PutUint64(zip64[12:], compressedSize)
+			binary.LittleEndian.PutUint64(zip64[20:], uint64(offset))
+			extra = append(extra, zip64[:]...)
+		} else {
+			h.CompressedSize, h.UncompressedSize = uint32(compressedSize), uint32(uncompressedSize)
+			h.Offset = uint32(offset)
+		}
+		if len(extra) > maxUint16 {
+			return 0, fmt.Errorf("extra of %s is too long", e.Name)
+		}
+		h.NameLength, h.ExtraLength, h.CommentLength = uint16(len(e.Name)), uint16(len(extra)), uint16(len(e.Comment))
+		binary.Write(buf, binary.LittleEndian, h)
+		buf.WriteString(e.Name)
+		buf.Write(extra)
+		buf.WriteString(e.Comment)
+	}
+
+	records, dirSize, dirOffset := int64(len(zipReader.File)), int64(buf.Len()), zipReader.AppendOffset()+shift
+	end := directoryEnd{
+		Signature:     binary.LittleEndian.Uint32([]byte(directoryEndSignature)),
+		DirRecords:    uint16(records),
+		TotalRecords:  uint16(records),
+		Size:          uint32(dirSize),
+		Offset:        uint32(dirOffset),
+		CommentLength: uint16(len(zipReader.Comment)),
+	}
+	if records >= maxUint16 || dirSize >= maxUint32 || dirOffset >= maxUint32 {
+		binary.Write(buf, binary.LittleEndian, directory64End{
+			Signature:        directory64EndSignature,
+			RecordSize:       directory64EndLength - 12,
+			CreatorVersion:   zip64Version,
+			ReaderVersion:    zip64Version,
+			DirRecords:       uint64(records),
+			TotalRecords:     uint64(records),
+			Size:             uint64(dirSize),
+			Offset:           uint64(dirOffset),
+			LocatorSignature: directory64LocSignature,
+			EndOffset:        uint64(dirOffset + dirSize),
+			TotalDisks:       1,
+		})
+		end.DirRecords, end.TotalRecords = maxUint16, maxUint16
+		end.Size, end.Offset = maxUint32, maxUint32
+	}
+	binary.Write(buf, binary.LittleEndian, end)
+	buf.WriteString(zipReader.Comment)
+	return io.Copy(w, buf)
+}
+
+// crc32Combine returns the crc of the concatenation of two parts by their
+// crc, len2 is the length of the second part, the same as crc32_combine of
+// zlib
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	var even, odd [32]uint32
+	// the operator for one zero bit
+	odd[0] = crc32.IEEE
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	// the operators for two and four zero bits
+	gf2MatrixSquare(even[:], odd[:])
+	gf2MatrixSquare(odd[:], even[:])
+	// apply len2 zero bytes to crc1, the first square is for one zero byte
+	for {
+		gf2MatrixSquare(even[:], odd[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd[:], even[:])
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd[:], crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	sum := uint32(0)
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
@@ -0,0 +1,61 @@
+package packer
+
+import (
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// consts of the android app bundle sources
+const (
+	BundleExt = ".aab"
+	// BundleBaseModulePath is the base module of the bundle, the apk entries
+	// are under it, e.g. assets/a.txt at base/assets/a.txt
+	BundleBaseModulePath = "base/"
+	// BundleConfigPath marks an entry list as a bundle
+	BundleConfigPath = "BundleConfig.pb"
+)
+
+// bundleDirs are the directories of the module kept as is, the other apk
+// entries are under root/ of the module
+var bundleDirs = []string{"assets/", "lib/", "res/"}
+
+// IsBundle reports whether the entries are of an android app bundle, the
+// bundle is signed by the jar signer like the v1 scheme of the apk
+func IsBundle(zipReader *zip.Reader) bool {
+	for _, e := range zipReader.File {
+		if e.Name == BundleConfigPath {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleEntryPath returns the entry path in the base module of the bundle for
+// the apk entry path name
+func bundleEntryPath(name string) string {
+	for _, dir := range bundleDirs {
+		if strings.HasPrefix(name, dir) {
+			return BundleBaseModulePath + name
+		}
+	}
+	return BundleBaseModulePath + "root/" + name
+}
+
+// APKEntryPath reverts the entry path in the base module of the bundle to the
+// apk entry path, ok is false if name is not an apk entry of the base module
+func APKEntryPath(name string) (string, bool) {
+	if !strings.HasPrefix(name, BundleBaseModulePath) {
+		return "", false
+	}
+	name = strings.TrimPrefix(name, BundleBaseModulePath)
+	for _, dir := range bundleDirs {
+		if strings.HasPrefix(name, dir) {
+			return name, true
+		}
+	}
+	if strings.HasPrefix(name, "root/") {
+		return strings.TrimPrefix(name, "root/"), true
+	}
+	return "", false
+}
@@ -0,0 +1,129 @@
+package packer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// ChannelCommentMagic ends the eocd comment with the channel, the comment is
+//
+//	[original comment][channel][len(channel) as uint16 little endian][magic]
+//
+// so the channel is parsed from the end of the apk without the zip reader
+const ChannelCommentMagic = "APK-CHANNEL"
+
+// MaxCommentLength is the max length of the eocd comment
+const MaxCommentLength = 1<<16 - 1
+
+const directoryEndSignature = "PK\x05\x06"
+
+// directoryEndLength is the length of the eocd without the comment
+const directoryEndLength = 22
+
+// SplitChannelComment splits the comment into the original comment and the
+// channel written in ModeComment, ok is false if there is no channel
+func SplitChannelComment(comment string) (orig, channel string, ok bool) {
+	if !strings.HasSuffix(comment, ChannelCommentMagic) {
+		return comment, "", false
+	}
+	end := len(comment) - len(ChannelCommentMagic) - 2
+	if end < 0 {
+		return comment, "", false
+	}
+	n := int(binary.LittleEndian.Uint16([]byte(comment[end:])))
+	if n > end {
+		return comment, "", false
+	}
+	return comment[:end-n], comment[end-n : end], true
+}
+
+// channelComment returns comment with the channel, the channel of the
+// previous repack is replaced
+func channelComment(comment, channel string) (string, error) {
+	orig, _, _ := SplitChannelComment(comment)
+	var size [2]byte
+	binary.LittleEndian.PutUint16(size[:], uint16(len(channel)))
+	res := orig + channel + string(size[:]) + ChannelCommentMagic
+	if len(channel) > MaxCommentLength || len(res) > MaxCommentLength {
+		return "", fmt.Errorf("comment is too long: %d, max: %d", len(res), MaxCommentLength)
+	}
+	// the zip readers search the eocd signature from the end
+	if strings.Contains(channel, directoryEndSignature) {
+		return "", fmt.Errorf("channel contains the eocd signature")
+	}
+	return res, nil
+}
+
+// writeBlockChannel writes the footer of the v2/v3 signed apk in src of size
+// bytes with the channel in the signing block to w, it returns the offset of
+// the signing block. The footer is the signing block with the channel pair,
+// the central directory and the eocd of the source with the new offset of the
+// central directory. The signatures cover the entries, the central directory
+// and the eocd without the offset, so they are still valid.
+func writeBlockChannel(w io.Writer, src io.ReaderAt, size int64, zipReader *zip.Reader, channel []byte) (int64, error) {
+	dirOffset := zipReader.AppendOffset()
+	pairs, blockSize, err := readSigningBlockPairs(src, dirOffset)
+	if err != nil {
+		return 0, fmt.Errorf("signing block: %v", err)
+	}
+
+	// the apk signature scheme requires the eocd right after the central
+	// directory at the end of the file, zip64 is not supported
+	endOffset := size - directoryEndLength - int64(len(zipReader.Comment))
+	if endOffset < dirOffset {
+		return 0, fmt.Errorf("invalid eocd offset: %d", endOffset)
+	}
+	end := make([]byte, size-endOffset)
+	if _, err := src.ReadAt(end, endOffset); err != nil {
+		return 0, fmt.Errorf("read eocd: %v", err)
+	}
+	if string(end[:4]) != directoryEndSignature {
+		return 0, fmt.Errorf("eocd is not at the end of the apk")
+	}
+	if binary.LittleEndian.Uint32(end[16:]) == maxUint32 {
+		return 0, fmt.Errorf("zip64 is not supported by the signing block")
+	}
+	if int64(binary.LittleEndian.Uint32(end[12:])) != endOffset-dirOffset {
+		return 0, fmt.Errorf("central directory is not followed by the eocd")
+	}
+
+	// the channel of the previous repack is replaced, the padding is
+	// recomputed
+	aligned := false
+	kept := make([]signingBlockPair, 0, len(pairs)+1)
+	for _, p := range pairs {
+		switch p.ID {
+		case signingBlockPaddingID:
+			aligned = true
+		case SigningBlockChannelID:
+		default:
+			kept = append(kept, p)
+		}
+	}
+	kept = append(kept, signingBlockPair{ID: SigningBlockChannelID, Value: channel})
+	block := marshalSigningBlock(kept, aligned)
+	if len(block) > maxSigningBlockSize {
+		return 0, fmt.Errorf("signing block is too large: %d", len(block))
+	}
+
+	blockOffset := dirOffset - blockSize
+	dir := make([]byte, endOffset-dirOffset)
+	if _, err := src.ReadAt(dir, dirOffset); err != nil {
+		return 0, fmt.Errorf("read central directory: %v", err)
+	}
+	newDirOffset := blockOffset + int64(len(block))
+	if newDirOffset >= maxUint32 {
+		return 0, fmt.Errorf("central directory offset is too large: %d", newDirOffset)
+	}
+	binary.LittleEndian.PutUint32(end[16:], uint32(newDirOffset))
+	for _, b := range [][]byte{block, dir, end} {
+		if _, err := w.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return blockOffset, nil
+}
@@ -0,0 +1,131 @@
+package packer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// writeSignedZip returns a stored zip of the entries with a signing block of
+// the pairs before the central directory
+func writeSignedZip(t *testing.T, entries []testEntry, pairs []signingBlockPair, align bool) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, e := range entries {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: e.Name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(e.Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirOffset := r.AppendOffset()
+	block := marshalSigningBlock(pairs, align)
+	src := append([]byte{}, buf.Bytes()[:dirOffset]...)
+	src = append(src, block...)
+	src = append(src, buf.Bytes()[dirOffset:]...)
+	end := src[len(src)-directoryEndLength:]
+	binary.LittleEndian.PutUint32(end[16:], uint32(dirOffset)+uint32(len(block)))
+	return src
+}
+
+// repackedBytes lays out the repacked file by the segments of the footer
+func repackedBytes(src []byte, f *Footer) []byte {
+	out := []byte{}
+	for _, s := range f.Segments {
+		if s.Footer {
+			out = append(out, f.Data[s.Offset:s.Offset+s.Size]...)
+		} else {
+			out = append(out, src[s.Offset:s.Offset+s.Size]...)
+		}
+	}
+	return out
+}
+
+func TestRepackCommentSigningBlock(t *testing.T) {
+	entries := []testEntry{
+		{Name: "AndroidManifest.xml", Data: []byte("manifest")},
+		{Name: "classes.dex", Data: []byte("dex")},
+	}
+	v2 := []byte("v2 signature")
+	for _, align := range []bool{false, true} {
+		src := writeSignedZip(t, entries, []signingBlockPair{{ID: SigningBlockV2ID, Value: v2}}, align)
+		srcReader, err := zip.NewReader(bytes.NewReader(src), int64(len(src)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcDir := src[srcReader.AppendOffset():]
+
+		for _, channel := range []string{"xiaomi", "huawei"} {
+			footer, err := Repack(context.Background(), bytes.NewReader(src), int64(len(src)), &Channel{
+				Mode:    ModeComment,
+				Content: []byte(channel),
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := repackedBytes(src, footer)
+			if int64(len(out)) != footer.Size() {
+				t.Fatalf("size: %d, want %d", len(out), footer.Size())
+			}
+			r, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkEntries(t, r, []string{"AndroidManifest.xml", "classes.dex"}, map[string]string{
+				"AndroidManifest.xml": "manifest",
+				"classes.dex":         "dex",
+			})
+
+			pairs, size, err := readSigningBlockPairs(bytes.NewReader(out), r.AppendOffset())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if align && size%signingBlockAlignment != 0 {
+				t.Errorf("signing block size: %d, want aligned", size)
+			}
+			got := map[uint32][]byte{}
+			for _, p := range pairs {
+				if _, ok := got[p.ID]; ok {
+					t.Errorf("duplicated pair: %#x", p.ID)
+				}
+				got[p.ID] = p.Value
+			}
+			if !bytes.Equal(got[SigningBlockV2ID], v2) {
+				t.Errorf("v2 pair: %q, want %q", got[SigningBlockV2ID], v2)
+			}
+			if string(got[SigningBlockChannelID]) != channel {
+				t.Errorf("channel pair: %q, want %q", got[SigningBlockChannelID], channel)
+			}
+
+			// the signed parts are not changed: the entries, the central
+			// directory and the eocd except the offset
+			blockOffset := r.AppendOffset() - size
+			if !bytes.Equal(out[:blockOffset], src[:blockOffset]) {
+				t.Errorf("entries are changed")
+			}
+			dir := out[r.AppendOffset():]
+			if !bytes.Equal(dir[:len(dir)-directoryEndLength+16], srcDir[:len(srcDir)-directoryEndLength+16]) {
+				t.Errorf("central directory is changed")
+			}
+			if r.Comment != srcReader.Comment {
+				t.Errorf("comment: %q, want %q", r.Comment, srcReader.Comment)
+			}
+
+			// the output is repacked again, the channel is replaced
+			src = out
+		}
+	}
+}
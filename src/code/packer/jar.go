@@ -0,0 +1,324 @@
+package packer
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"repack/logger"
+	"repack/manifest"
+	"strings"
+	"time"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// consts ...
+const (
+	MetaInfoPath = "META-INF/"
+	ManifestPath = "META-INF/MANIFEST.MF"
+	SFPath       = "META-INF/%s.SF"
+	BlockPath    = "META-INF/%s.%s"
+	SigFileName  = "CERT"
+)
+
+// digestAttributes are the digests of the entries in the manifest
+var digestAttributes = map[string]func([]byte) string{
+	"sha1-digest":    sha1Sum,
+	"sha-256-digest": sha256Sum,
+}
+
+// sha1Sum ...
+func sha1Sum(msg []byte) string {
+	sha := sha1.Sum(msg)
+	return base64.StdEncoding.EncodeToString(sha[:])
+}
+
+// sha256Sum ...
+func sha256Sum(msg []byte) string {
+	sha := sha256.Sum256(msg)
+	return base64.StdEncoding.EncodeToString(sha[:])
+}
+
+// signChannel returns the entries of the channel with the new MANIFEST.MF and
+// v1 signature, in the order they are written
+func (p *Packer) signChannel(ctx context.Context, r *zip.Reader, ch *Channel) ([]File, error) {
+	if err := ValidateEntryPath(ch.Path); err != nil {
+		return nil, err
+	}
+	if p.Signer == nil {
+		return nil, fmt.Errorf("no signer")
+	}
+	buf, sigName, err := readManifest(r, p.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if p.SignatureName != "" {
+		sigName = p.SignatureName
+	}
+	m, err := manifest.Parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("parse manifest: %v", err)
+	}
+
+	// the channel file and the extra files are in the base module of the
+	// bundle
+	bundle := IsBundle(r)
+	entryPath := func(name string) string {
+		if bundle {
+			return bundleEntryPath(name)
+		}
+		return name
+	}
+	entries := []File{{Name: entryPath(ch.Path), Content: ch.Content}}
+	for _, f := range ch.Extras {
+		if err := ValidateEntryPath(f.Name); err != nil {
+			return nil, err
+		}
+		entries = append(entries, File{Name: entryPath(f.Name), Content: f.Content})
+	}
+	if len(ch.MetaData) > 0 {
+		if bundle {
+			// the manifest of the bundle is in protobuf
+			return nil, fmt.Errorf("meta-data is not supported for %s sources", BundleExt)
+		}
+		content, err := changeMetaData(r, ch.MetaData, p.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("change meta-data: %v", err)
+		}
+		entries = append(entries, File{Name: AndroidManifestPath, Content: content})
+	}
+	written := map[string]bool{}
+	for _, e := range entries {
+		if written[e.Name] {
+			return nil, fmt.Errorf("extra file %s conflicts with the channel file", e.Name)
+		}
+		written[e.Name] = true
+		p.Logger.Debugf("set manifest section: %s", e.Name)
+		setManifestEntry(m, e.Name, e.Content)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ext, err := blockExt(p.Signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	mf := m.Bytes()
+	sf := signatureFile(mf, m)
+	block, err := p.Signer.Sign(sf)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %v", err)
+	}
+	return append(entries,
+		File{Name: ManifestPath, Content: mf},
+		File{Name: fmt.Sprintf(SFPath, sigName), Content: sf},
+		File{Name: fmt.Sprintf(BlockPath, sigName, ext), Content: block},
+	), nil
+}
+
+// setManifestEntry sets the digests of the entry in the manifest. The digests
+// of the section are updated, the new section has the digests of the other
+// entries, SHA1-Digest by default. The files in META-INF/ are not signed, the
+// stale section is removed if any.
+func setManifestEntry(m *manifest.Manifest, name string, content []byte) {
+	if !isSignedEntry(name) {
+		m.RemoveSection(name)
+		return
+	}
+	s := m.Section(name)
+	if s == nil {
+		digests := []string{"SHA1-Digest"}
+		for _, other := range m.Sections {
+			if d := sectionDigests(other); len(d) > 0 {
+				digests = d
+				break
+			}
+		}
+		s = m.AddSection(name)
+		for _, d := range digests {
+			s.Set(d, digestAttributes[strings.ToLower(d)](content))
+		}
+		return
+	}
+
+	digests := sectionDigests(s)
+	for _, a := range append([]manifest.Attribute(nil), s.Attributes...) {
+		// the digests of unknown algorithms would be stale
+		if strings.HasSuffix(strings.ToLower(a.Name), "-digest") && digestAttributes[strings.ToLower(a.Name)] == nil {
+			s.Delete(a.Name)
+		}
+	}
+	if len(digests) == 0 {
+		digests = []string{"SHA1-Digest"}
+	}
+	for _, d := range digests {
+		s.Set(d, digestAttributes[strings.ToLower(d)](content))
+	}
+}
+
+// sectionDigests returns the attribute names of the known digests of s
+func sectionDigests(s *manifest.Section) []string {
+	names := []string{}
+	for _, a := range s.Attributes {
+		if digestAttributes[strings.ToLower(a.Name)] != nil {
+			names = append(names, a.Name)
+		}
+	}
+	return names
+}
+
+// signatureFile returns the .SF of the manifest mf, the digest of a section is
+// over its bytes in mf, including the wrapped lines and the empty line after it
+func signatureFile(mf []byte, m *manifest.Manifest) []byte {
+	sf := manifest.New()
+	sf.Main.Set("Signature-Version", "1.0")
+	sf.Main.Set("SHA1-Digest-Manifest", sha1Sum(mf))
+	for _, s := range m.Sections {
+		sf.AddSection(s.Name()).Set("SHA1-Digest", sha1Sum(s.Bytes()))
+	}
+	return sf.Bytes()
+}
+
+// readManifest returns MANIFEST.MF of r and the name of its signature files,
+// SigFileName if r is not signed
+func readManifest(r *zip.Reader, l *logger.Logger) ([]byte, string, error) {
+	var manifest []byte
+	sigName := ""
+	for _, f := range r.File {
+		if f.Name == ManifestPath {
+			l.Debugf("found manifest: %s", f.Name)
+			buf, err := readEntry(f)
+			if err != nil {
+				return nil, "", err
+			}
+			manifest = buf
+		}
+
+		if strings.HasSuffix(f.Name, ".SF") &&
+			strings.HasPrefix(f.Name, MetaInfoPath) {
+			l.Debugf("found signature file: %s", f.Name)
+
+			sigName = strings.TrimSuffix(f.Name, ".SF")
+			sigName = strings.TrimPrefix(sigName, MetaInfoPath)
+		}
+
+		if manifest != nil && sigName != "" {
+			return manifest, sigName, nil
+		}
+	}
+
+	if manifest == nil {
+		return nil, "", fmt.Errorf("manifest file not found")
+	}
+	l.Infof("using signature file name: %s", SigFileName)
+	return manifest, SigFileName, nil
+}
+
+// writeEntry writes the new entry f
+func writeEntry(w *zip.Writer, f File) error {
+	header := &zip.FileHeader{
+		Name:   f.Name,
+		Method: entryMethod(f.Name),
+	}
+	header.SetModTime(time.Now())
+
+	df, err := createEntry(w, header, f.Content)
+	if err != nil {
+		return err
+	}
+	_, err = df.Write(f.Content)
+	return err
+}
+
+// alignment of the stored entries like zipalign -p, the native libraries are
+// page aligned so they can be mapped from the apk
+const (
+	EntryAlignment   = 4
+	LibraryAlignment = 4096
+)
+
+// entryMethod returns the method of the appended entry, the native libraries
+// and resources.arsc are stored to be mapped from the apk, the others are
+// deflated
+func entryMethod(name string) uint16 {
+	if strings.HasSuffix(name, ".so") || name == "resources.arsc" {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// createEntry adds the entry of content to w. The data of the stored entry
+// is aligned and its crc and sizes are in the local header without a data
+// descriptor, so the apk passes zipalign -c
+func createEntry(w *zip.Writer, header *zip.FileHeader, content []byte) (io.Writer, error) {
+	if header.Method != zip.Store {
+		return w.CreateHeader(header)
+	}
+	align := EntryAlignment
+	if strings.HasSuffix(header.Name, ".so") {
+		align = LibraryAlignment
+	}
+	header.CRC32 = crc32.ChecksumIEEE(content)
+	header.CompressedSize64 = uint64(len(content))
+	header.UncompressedSize64 = uint64(len(content))
+	return w.CreateAlignedRaw(header, align)
+}
+
+// removeSignatureFiles removes the signature files of r from the central
+// directory, the source may have several signers, e.g. RELEASE.SF with
+// RELEASE.RSA and a stale CERT.DSA, which are broken by the new entries.
+// The new signer is written by signChannel.
+func removeSignatureFiles(w *zip.Writer, r *zip.Reader, l *logger.Logger) error {
+	for _, f := range r.File {
+		if !IsSignatureFile(f.Name) {
+			continue
+		}
+		l.Debugf("remove signature file: %s", f.Name)
+		if _, err := w.Remove(f.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateEntryPath checks name is a relative path of a file in the apk,
+// and not one of the signature files
+func ValidateEntryPath(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") ||
+		strings.Contains(name, "\\") {
+		return fmt.Errorf("invalid channel file path: %q", name)
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return fmt.Errorf("invalid channel file path: %q", name)
+		}
+	}
+	if name == ManifestPath || IsSignatureFile(name) {
+		return fmt.Errorf("channel file path %s conflicts with the signature", name)
+	}
+	return nil
+}
+
+// IsSignatureFile reports whether name is a signature file in META-INF/
+func IsSignatureFile(name string) bool {
+	if !strings.HasPrefix(name, MetaInfoPath) || strings.Contains(name[len(MetaInfoPath):], "/") {
+		return false
+	}
+	switch strings.ToUpper(path.Ext(name)) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return false
+}
+
+// isSignedEntry reports whether the entry name is covered by the v1
+// signature, the files in META-INF/ are not
+func isSignedEntry(name string) bool {
+	return !strings.HasPrefix(name, MetaInfoPath)
+}
@@ -0,0 +1,47 @@
+package packer
+
+import (
+	"fmt"
+	"repack/axml"
+	"repack/logger"
+	"sort"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// AndroidManifestPath is the binary xml manifest of the apk
+const AndroidManifestPath = "AndroidManifest.xml"
+
+// changeMetaData returns AndroidManifest.xml of r with the <meta-data> values
+func changeMetaData(r *zip.Reader, values map[string]string, l *logger.Logger) ([]byte, error) {
+	var buf []byte
+	for _, f := range r.File {
+		if f.Name != AndroidManifestPath {
+			continue
+		}
+		var err error
+		if buf, err = readEntry(f); err != nil {
+			return nil, err
+		}
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("%s not found", AndroidManifestPath)
+	}
+
+	doc, err := axml.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l.Debugf("set meta-data %s: %s", name, values[name])
+		if err := doc.SetMetaData(name, values[name]); err != nil {
+			return nil, err
+		}
+	}
+	return doc.Bytes(), nil
+}
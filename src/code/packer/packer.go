@@ -0,0 +1,212 @@
+// Package packer writes the channel into an apk, an android app bundle or the
+// base apk of an apk set without rewriting the source. The channel files and
+// the new v1 signature are appended after the entries of the source with a
+// new central directory, the footer. The repacked file is laid out by the
+// segments of the source and the footer, so it can be served from the source
+// in place.
+//
+//	footer, err := packer.Repack(ctx, src, size, &packer.Channel{
+//		Path:    "assets/dap.properties",
+//		Content: []byte("xiaomi"),
+//	}, signer)
+package packer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"repack/logger"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// modes to write the channel
+const (
+	// ModeFile writes the channel file into the apk and re-signs it
+	ModeFile = "file"
+	// ModeComment writes the channel into the eocd comment, the entries and
+	// the signature are not changed. The v2/v3 signatures cover the eocd, so
+	// the channel of the v2/v3 signed sources is written into the apk signing
+	// block as the SigningBlockChannelID pair instead.
+	ModeComment = "comment"
+)
+
+// Channel is what's written into the source
+type Channel struct {
+	// Mode is one of the Mode consts, ModeFile if empty
+	Mode string
+	// Path is the entry of the channel file in the apk, it's written in the
+	// base module of the bundle, e.g. assets/dap.properties at
+	// base/assets/dap.properties
+	Path string
+	// Content is the channel file, or the channel in the eocd comment or the
+	// signing block in ModeComment
+	Content []byte
+	// MetaData is the <meta-data> values set in AndroidManifest.xml by name
+	MetaData map[string]string
+	// Extras are written besides the channel file, the bundle paths are
+	// mapped like Path
+	Extras []File
+}
+
+// File is an extra file of the channel
+type File struct {
+	// Name is the entry path in the apk
+	Name    string
+	Content []byte
+}
+
+// Segment is a part of the repacked file read from the source or the footer
+type Segment struct {
+	Footer bool `json:",omitempty"`
+	Offset int64
+	Size   int64
+}
+
+// Footer is the data appended to the source and the layout of the repacked
+// file
+type Footer struct {
+	Data     []byte
+	Segments []Segment
+}
+
+// SourceSize returns the bytes of the repacked file read from the source
+func (f *Footer) SourceSize() int64 {
+	size := int64(0)
+	for _, s := range f.Segments {
+		if !s.Footer {
+			size += s.Size
+		}
+	}
+	return size
+}
+
+// Size returns the size of the repacked file
+func (f *Footer) Size() int64 {
+	return f.SourceSize() + int64(len(f.Data))
+}
+
+// Packer repacks the sources with the signer
+type Packer struct {
+	// Signer signs the v1 signature, it's not used in ModeComment
+	Signer Signer
+	// SignatureName is the name of the v1 signature files, e.g. CERT of
+	// META-INF/CERT.SF. The name of the source signature is kept if empty,
+	// or SigFileName if the source has none.
+	SignatureName string
+	// PrefixCRC returns the crc32 of the source in [offset, offset+size), the
+	// base apk of the apk set before its footer. It's the same for all
+	// channels of the source so it may be cached, it's computed if nil.
+	PrefixCRC func(offset, size int64) (uint32, error)
+	// Logger is the logger of the packer, the logs are untagged if nil
+	Logger *logger.Logger
+}
+
+// Repack repacks the source of size bytes with the channel signed by signer
+func Repack(ctx context.Context, src io.ReaderAt, size int64, ch *Channel, signer Signer) (*Footer, error) {
+	p := &Packer{Signer: signer}
+	return p.Repack(ctx, src, size, ch)
+}
+
+// Repack repacks the source of size bytes with the channel, the base apk is
+// repacked for the apk set
+func (p *Packer) Repack(ctx context.Context, src io.ReaderAt, size int64, ch *Channel) (*Footer, error) {
+	zipReader, err := zip.NewReader(src, size)
+	if err != nil {
+		return nil, fmt.Errorf("zip reader: %v", err)
+	}
+	if IsAPKSet(zipReader) {
+		return p.repackAPKSet(ctx, src, zipReader, ch)
+	}
+
+	w := &bytes.Buffer{}
+	appendOffset, err := p.repackZip(ctx, w, src, size, zipReader, ch)
+	if err != nil {
+		return nil, err
+	}
+	return &Footer{
+		Data: w.Bytes(),
+		Segments: []Segment{
+			{Offset: 0, Size: appendOffset},
+			{Footer: true, Offset: 0, Size: int64(w.Len())},
+		},
+	}, nil
+}
+
+// repackZip writes the footer of the apk or the bundle in src of size bytes to
+// w, it returns the append offset
+func (p *Packer) repackZip(ctx context.Context, w io.Writer, src io.ReaderAt, size int64, zipReader *zip.Reader, ch *Channel) (int64, error) {
+	appendOffset := zipReader.AppendOffset()
+	p.Logger.Debugf("append offset: %d", appendOffset)
+
+	var writer *zip.Writer
+	if ch.Mode == ModeComment {
+		// the v2/v3 signatures cover the eocd, a changed comment fails the
+		// verification of the installer
+		signed, err := hasSignatureScheme(src, appendOffset)
+		if err != nil {
+			return 0, fmt.Errorf("signing block: %v", err)
+		}
+		if signed {
+			return writeBlockChannel(w, src, size, zipReader, ch.Content)
+		}
+		comment, err := channelComment(zipReader.Comment, string(ch.Content))
+		if err != nil {
+			return 0, fmt.Errorf("copy comment: %v", err)
+		}
+		writer = zipReader.Append(w)
+		if err := writer.SetComment(comment); err != nil {
+			return 0, fmt.Errorf("copy comment: %v", err)
+		}
+	} else {
+		entries, err := p.signChannel(ctx, zipReader, ch)
+		if err != nil {
+			return 0, err
+		}
+
+		// the entries are appended at the central directory, a v2/v3 signing
+		// block of the source is left before them and is not a signing block
+		// of the output anymore. The output is v1 signed only, so there is no
+		// signing block to align before the new central directory.
+		writer = zipReader.Append(w)
+		if err := removeSignatureFiles(writer, zipReader, p.Logger); err != nil {
+			return 0, fmt.Errorf("remove signature files: %v", err)
+		}
+		// the channel file, the extra files, AndroidManifest.xml and the
+		// signature: MANIFEST.MF/CERT.SF/CERT.RSA
+		for _, e := range entries {
+			if err := writeEntry(writer, e); err != nil {
+				return 0, fmt.Errorf("write %s: %v", e.Name, err)
+			}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf("close zip writer: %v", err)
+	}
+	return appendOffset, nil
+}
+
+// prefixCRC returns the crc of the source in [offset, offset+size)
+func (p *Packer) prefixCRC(src io.ReaderAt, offset, size int64) (uint32, error) {
+	if p.PrefixCRC != nil {
+		return p.PrefixCRC(offset, size)
+	}
+	h := crc32.NewIEEE()
+	if n, err := io.Copy(h, io.NewSectionReader(src, offset, size)); err != nil || n != size {
+		return 0, fmt.Errorf("read base apk: %v, n: %d", err, n)
+	}
+	return h.Sum32(), nil
+}
+
+func readEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
@@ -0,0 +1,111 @@
+package packer
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mozilla-services/pkcs7"
+)
+
+// Signer signs the .SF of the v1 signature
+type Signer interface {
+	// Sign returns the detached pkcs7 signature block of sf, e.g. CERT.RSA
+	Sign(sf []byte) ([]byte, error)
+	// Public returns the public key of the signer, it decides the extension
+	// of the signature block
+	Public() crypto.PublicKey
+}
+
+// blockExt returns the extension of the signature block of the key, RSA, EC
+// or DSA as the jar specification
+func blockExt(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA", nil
+	case *ecdsa.PublicKey:
+		return "EC", nil
+	case *dsa.PublicKey:
+		return "DSA", nil
+	}
+	return "", fmt.Errorf("unsupported public key: %T", pub)
+}
+
+// KeySigner signs with the certificate and the private key in process
+type KeySigner struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Public returns the public key of the certificate
+func (s *KeySigner) Public() crypto.PublicKey {
+	return s.Cert.PublicKey
+}
+
+// Sign returns the detached pkcs7 of sf without authenticated attributes,
+// the same as `openssl smime -sign -binary -noattr -outform DER`
+func (s *KeySigner) Sign(sf []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(sf)
+	if err != nil {
+		return nil, fmt.Errorf("signed data: %v", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.SignWithoutAttr(s.Cert, s.Key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("sign: %v", err)
+	}
+	sd.Detach()
+	return sd.Finish()
+}
+
+// LoadKeySigner parses the pem files of the certificate and the private key
+func LoadKeySigner(certPath, keyPath string) (*KeySigner, error) {
+	buf, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode pem: %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate %s: %v", certPath, err)
+	}
+
+	buf, err = ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode pem: %s", keyPath)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse private key %s: %v", keyPath, err)
+	}
+	priv, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key: %T", key)
+	}
+
+	pub, ok := priv.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("private key %s doesn't match certificate %s", keyPath, certPath)
+	}
+
+	return &KeySigner{Cert: cert, Key: priv}, nil
+}
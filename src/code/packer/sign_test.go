@@ -0,0 +1,54 @@
+package packer
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestBlockExt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		pub  crypto.PublicKey
+		want string
+	}{
+		{"rsa", rsaKey.Public(), "RSA"},
+		{"ec", ecKey.Public(), "EC"},
+		{"dsa", &dsa.PublicKey{}, "DSA"},
+		{"ed25519", edKey, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := blockExt(c.pub)
+			if c.want == "" {
+				if err == nil {
+					t.Fatalf("blockExt() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("blockExt() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package packer
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ids of the pairs in the apk signing block
+const (
+	SigningBlockV2ID = 0x7109871a
+	SigningBlockV3ID = 0xf05368c0
+	// channel ids of Walle and VasDolly
+	SigningBlockWalleID    = 0x71777777
+	SigningBlockVasDollyID = 0x881155ff
+	// SigningBlockChannelID is the pair of the channel written in ModeComment,
+	// it's the VasDolly id so the VasDolly readers of the clients get it
+	SigningBlockChannelID = SigningBlockVasDollyID
+	// the padding pair aligns the block to 4096 bytes for apk verity
+	signingBlockPaddingID = 0x42726577
+	signingBlockAlignment = 4096
+
+	signingBlockMagic   = "APK Sig Block 42"
+	maxSigningBlockSize = 64 * 1024 * 1024
+)
+
+// signingBlockPair is an id-value pair of the apk signing block
+type signingBlockPair struct {
+	ID    uint32
+	Value []byte
+}
+
+// ReadSigningBlock returns the id-value pairs of the apk signing block before
+// the central directory at dirOffset, it's nil if there is no signing block
+func ReadSigningBlock(r io.ReaderAt, dirOffset int64) (map[uint32][]byte, error) {
+	list, _, err := readSigningBlockPairs(r, dirOffset)
+	if err != nil || list == nil {
+		return nil, err
+	}
+	pairs := map[uint32][]byte{}
+	for _, p := range list {
+		pairs[p.ID] = p.Value
+	}
+	return pairs, nil
+}
+
+// readSigningBlockPairs returns the pairs of the apk signing block before the
+// central directory at dirOffset in order and the size of the block, the
+// pairs are nil if there is no signing block
+func readSigningBlockPairs(r io.ReaderAt, dirOffset int64) ([]signingBlockPair, int64, error) {
+	if dirOffset < 32 {
+		return nil, 0, nil
+	}
+	var footer [24]byte
+	if _, err := r.ReadAt(footer[:], dirOffset-24); err != nil {
+		return nil, 0, err
+	}
+	if string(footer[8:]) != signingBlockMagic {
+		return nil, 0, nil
+	}
+	size := int64(binary.LittleEndian.Uint64(footer[:8]))
+	if size < 24 || size > maxSigningBlockSize || size+8 > dirOffset {
+		return nil, 0, fmt.Errorf("invalid signing block size: %d", size)
+	}
+
+	// the block is the size, pairs, the size again and the magic, the size
+	// excludes the first size field
+	buf := make([]byte, size-24)
+	if _, err := r.ReadAt(buf, dirOffset-size); err != nil {
+		return nil, 0, err
+	}
+	pairs := []signingBlockPair{}
+	for len(buf) > 0 {
+		if len(buf) < 12 {
+			return nil, 0, fmt.Errorf("truncated signing block pair")
+		}
+		n := binary.LittleEndian.Uint64(buf)
+		if n < 4 || n > uint64(len(buf)-8) {
+			return nil, 0, fmt.Errorf("invalid signing block pair size: %d", n)
+		}
+		pairs = append(pairs, signingBlockPair{
+			ID:    binary.LittleEndian.Uint32(buf[8:]),
+			Value: buf[12 : 8+n],
+		})
+		buf = buf[8+n:]
+	}
+	return pairs, size + 8, nil
+}
+
+// marshalSigningBlock returns the apk signing block of the pairs, it's padded
+// to 4096 bytes if align is true
+func marshalSigningBlock(pairs []signingBlockPair, align bool) []byte {
+	size := 8 + 8 + len(signingBlockMagic)
+	for _, p := range pairs {
+		size += 12 + len(p.Value)
+	}
+	if rem := size % signingBlockAlignment; align && rem != 0 {
+		padding := (2*signingBlockAlignment - rem - 12) % signingBlockAlignment
+		pairs = append(pairs, signingBlockPair{ID: signingBlockPaddingID, Value: make([]byte, padding)})
+		size += 12 + padding
+	}
+
+	buf := make([]byte, 0, size)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(size-8))
+	buf = append(buf, b[:]...)
+	for _, p := range pairs {
+		binary.LittleEndian.PutUint64(b[:], uint64(len(p.Value)+4))
+		buf = append(buf, b[:]...)
+		binary.LittleEndian.PutUint32(b[:], p.ID)
+		buf = append(buf, b[:4]...)
+		buf = append(buf, p.Value...)
+	}
+	binary.LittleEndian.PutUint64(b[:], uint64(size-8))
+	buf = append(buf, b[:]...)
+	return append(buf, signingBlockMagic...)
+}
+
+// hasSignatureScheme is true if the apk signing block before the central
+// directory at dirOffset has the v2 or v3 signature
+func hasSignatureScheme(r io.ReaderAt, dirOffset int64) (bool, error) {
+	pairs, err := ReadSigningBlock(r, dirOffset)
+	if err != nil {
+		return false, err
+	}
+	_, v2 := pairs[SigningBlockV2ID]
+	_, v3 := pairs[SigningBlockV3ID]
+	return v2 || v3, nil
+}
+
+// lengthPrefixed splits the uint32 length prefixed value from buf
+func lengthPrefixed(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("truncated length prefixed value")
+	}
+	n := binary.LittleEndian.Uint32(buf)
+	if uint64(n) > uint64(len(buf)-4) {
+		return nil, nil, fmt.Errorf("invalid length: %d", n)
+	}
+	return buf[4 : 4+n], buf[4+n:], nil
+}
+
+// SigningBlockCerts returns the certificates of the signers of the v2 or v3
+// scheme block, their signed data both start with the digests and the
+// certificates
+func SigningBlockCerts(block []byte) ([]*x509.Certificate, error) {
+	signers, _, err := lengthPrefixed(block)
+	if err != nil {
+		return nil, err
+	}
+	certs := []*x509.Certificate{}
+	for len(signers) > 0 {
+		var signer, signedData, certsData, certData []byte
+		if signer, signers, err = lengthPrefixed(signers); err != nil {
+			return nil, err
+		}
+		if signedData, _, err = lengthPrefixed(signer); err != nil {
+			return nil, err
+		}
+		// skip the digests
+		if _, signedData, err = lengthPrefixed(signedData); err != nil {
+			return nil, err
+		}
+		if certsData, _, err = lengthPrefixed(signedData); err != nil {
+			return nil, err
+		}
+		for len(certsData) > 0 {
+			if certData, certsData, err = lengthPrefixed(certsData); err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(certData)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
@@ -0,0 +1,177 @@
+package packer
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"path"
+	"repack/manifest"
+	"strings"
+
+	"github.com/mozilla-services/pkcs7"
+	"github.com/rsc/zipmerge/zip"
+)
+
+// manifestDigestSuffix ends the digests of the whole manifest in the .SF,
+// e.g. SHA-256-Digest-Manifest
+const manifestDigestSuffix = "-manifest"
+
+// Signature is a v1 signature of the apk
+type Signature struct {
+	// File is the signature block, e.g. META-INF/CERT.RSA
+	File string
+	Cert *x509.Certificate
+}
+
+// Verify verifies the v1 signature of the apk read from r, the base apk is
+// verified for the apk set. It returns the signatures.
+func Verify(r io.ReaderAt, size int64) ([]Signature, error) {
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("zip reader: %v", err)
+	}
+	if IsAPKSet(zipReader) {
+		base, offset, err := FindBaseAPK(zipReader)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(base.CompressedSize64)
+		signatures, err := Verify(io.NewSectionReader(r, offset, size), size)
+		if err != nil {
+			return nil, fmt.Errorf("verify %s: %v", base.Name, err)
+		}
+		return signatures, nil
+	}
+	return verifyJAR(zipReader)
+}
+
+// verifyJAR checks the digests of the entries in MANIFEST.MF, the digests of
+// MANIFEST.MF in the .SF files and the pkcs7 signatures of the .SF files
+func verifyJAR(r *zip.Reader) ([]Signature, error) {
+	entries := map[string]*zip.File{}
+	for _, e := range r.File {
+		if entries[e.Name] != nil {
+			return nil, fmt.Errorf("duplicate entry %s", e.Name)
+		}
+		entries[e.Name] = e
+	}
+	if entries[ManifestPath] == nil {
+		return nil, fmt.Errorf("%s not found", ManifestPath)
+	}
+	mf, err := readEntry(entries[ManifestPath])
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", ManifestPath, err)
+	}
+	m, err := manifest.Parse(mf)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %v", ManifestPath, err)
+	}
+
+	for _, e := range r.File {
+		if !isSignedEntry(e.Name) || strings.HasSuffix(e.Name, "/") {
+			continue
+		}
+		s := m.Section(e.Name)
+		if s == nil {
+			return nil, fmt.Errorf("%s is not in %s", e.Name, ManifestPath)
+		}
+		content, err := readEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %v", e.Name, err)
+		}
+		if err := checkDigests(s, content); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name, err)
+		}
+	}
+
+	signatures := []Signature{}
+	for _, e := range r.File {
+		ext := path.Ext(e.Name)
+		if !IsSignatureFile(e.Name) || strings.EqualFold(ext, ".SF") {
+			continue
+		}
+		sfName := strings.TrimSuffix(e.Name, ext) + ".SF"
+		if entries[sfName] == nil {
+			return nil, fmt.Errorf("%s without %s", e.Name, sfName)
+		}
+		sf, err := readEntry(entries[sfName])
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %v", sfName, err)
+		}
+		block, err := readEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %v", e.Name, err)
+		}
+		p7, err := pkcs7.Parse(block)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", e.Name, err)
+		}
+		p7.Content = sf
+		if err := p7.Verify(); err != nil {
+			return nil, fmt.Errorf("verify %s: %v", e.Name, err)
+		}
+		if err := checkSignatureFile(sf, mf, m); err != nil {
+			return nil, fmt.Errorf("%s: %v", sfName, err)
+		}
+		cert := p7.GetOnlySigner()
+		if cert == nil {
+			return nil, fmt.Errorf("%s has no signer", e.Name)
+		}
+		signatures = append(signatures, Signature{File: e.Name, Cert: cert})
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("no v1 signature")
+	}
+	return signatures, nil
+}
+
+// checkDigests compares the known digests of the section with content, at
+// least one of them is required
+func checkDigests(s *manifest.Section, content []byte) error {
+	n := 0
+	for _, a := range s.Attributes {
+		sum, ok := digestAttributes[strings.ToLower(a.Name)]
+		if !ok {
+			continue
+		}
+		if sum(content) != a.Value {
+			return fmt.Errorf("%s mismatch", a.Name)
+		}
+		n++
+	}
+	if n == 0 {
+		return fmt.Errorf("no supported digest")
+	}
+	return nil
+}
+
+// checkSignatureFile checks the digest of the whole manifest in the .SF, the
+// digests of the manifest sections are checked if it doesn't match
+func checkSignatureFile(sf, mf []byte, m *manifest.Manifest) error {
+	s, err := manifest.Parse(sf)
+	if err != nil {
+		return err
+	}
+	whole := &manifest.Section{}
+	for _, a := range s.Main.Attributes {
+		if name := strings.ToLower(a.Name); strings.HasSuffix(name, manifestDigestSuffix) {
+			whole.Attributes = append(whole.Attributes, manifest.Attribute{
+				Name:  strings.TrimSuffix(name, manifestDigestSuffix),
+				Value: a.Value,
+			})
+		}
+	}
+	if checkDigests(whole, mf) == nil {
+		return nil
+	}
+	for _, section := range m.Sections {
+		entry := s.Section(section.Name())
+		if entry == nil {
+			return fmt.Errorf("%s is not signed", section.Name())
+		}
+		if err := checkDigests(entry, section.Bytes()); err != nil {
+			return fmt.Errorf("section %s: %v", section.Name(), err)
+		}
+	}
+	return nil
+}
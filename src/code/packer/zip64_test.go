@@ -0,0 +1,327 @@
+package packer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rsc/zipmerge/zip"
+)
+
+// channelPath is the channel file of the test archives
+const channelPath = "assets/dap.properties"
+
+// hugeSize is the size of the zero filled entries, the entries after them
+// are beyond 4GB
+const hugeSize = 1<<32 + 1<<20
+
+var zeroBlock = make([]byte, 1<<20)
+
+// sparseWriter writes to the file, the zero blocks are skipped by seek so the
+// synthetic archives above 4GB take little disk space
+type sparseWriter struct {
+	f *os.File
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += len(zeroBlock) {
+		end := i + len(zeroBlock)
+		if end > len(p) {
+			end = len(p)
+		}
+		if !bytes.Equal(p[i:end], zeroBlock[:end-i]) {
+			return w.f.Write(p)
+		}
+	}
+	if _, err := w.f.Seek(int64(len(p)), io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *sparseWriter) Close() error {
+	offset, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := w.f.Truncate(offset); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+// testEntry is a stored entry of the synthetic archive, it's hugeSize zeros if
+// Data is nil
+type testEntry struct {
+	Name string
+	Data []byte
+}
+
+func writeSparseZip(t *testing.T, name string, entries []testEntry) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := &sparseWriter{f: f}
+	w := zip.NewWriter(sw)
+	for _, e := range entries {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: e.Name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Data != nil {
+			_, err = fw.Write(e.Data)
+		} else {
+			for n := int64(0); n < hugeSize && err == nil; n += int64(len(zeroBlock)) {
+				_, err = fw.Write(zeroBlock)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openSparseZip(t *testing.T, name string) (*os.File, *zip.Reader) {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, r
+}
+
+// multiReaderAt concatenates the sections like the segments of resultInfo
+type multiReaderAt []*io.SectionReader
+
+func (m multiReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, s := range m {
+		if n == len(p) {
+			break
+		}
+		if off >= s.Size() {
+			off -= s.Size()
+			continue
+		}
+		k, err := s.ReadAt(p[n:], off)
+		n += k
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		off = 0
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m multiReaderAt) Size() int64 {
+	size := int64(0)
+	for _, s := range m {
+		size += s.Size()
+	}
+	return size
+}
+
+func memorySection(b []byte) *io.SectionReader {
+	return io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+}
+
+// zip64Blocks counts the zip64 extra blocks of extra
+func zip64Blocks(extra []byte) int {
+	n := 0
+	for len(extra) >= 4 {
+		size := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if size > len(extra) {
+			break
+		}
+		if binary.LittleEndian.Uint16(extra) == zip64ExtraID {
+			n++
+		}
+		extra = extra[size:]
+	}
+	return n
+}
+
+// checkEntries reads the entries of r, want is the content of the entries
+// except the huge ones
+func checkEntries(t *testing.T, r *zip.Reader, names []string, want map[string]string) {
+	if len(r.File) != len(names) {
+		t.Fatalf("entries: %d, want: %d", len(r.File), len(names))
+	}
+	for i, e := range r.File {
+		if e.Name != names[i] {
+			t.Errorf("entry %d: %s, want: %s", i, e.Name, names[i])
+		}
+		if n := zip64Blocks(e.Extra); n > 1 {
+			t.Errorf("%s has %d zip64 extra blocks", e.Name, n)
+		}
+		content, ok := want[e.Name]
+		if !ok {
+			if e.UncompressedSize64 != hugeSize {
+				t.Errorf("%s size: %d, want: %d", e.Name, e.UncompressedSize64, uint64(hugeSize))
+			}
+			continue
+		}
+		got, err := readEntry(e)
+		if err != nil {
+			t.Fatalf("read %s: %v", e.Name, err)
+		}
+		if string(got) != content {
+			t.Errorf("%s: %q, want: %q", e.Name, got, content)
+		}
+	}
+}
+
+func TestAppendZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a sparse archive above 4GB")
+	}
+	dir, err := ioutil.TempDir("", "zip64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "app.apk")
+	writeSparseZip(t, name, []testEntry{
+		{Name: AndroidManifestPath, Data: []byte("manifest")},
+		{Name: "assets/huge.obb"},
+		{Name: channelPath, Data: []byte("original")},
+		{Name: "assets/after.txt", Data: []byte("after")},
+	})
+	f, r := openSparseZip(t, name)
+	defer f.Close()
+	if offset := r.File[3].HeaderOffset(); offset < 1<<32 {
+		t.Fatalf("offset of %s: %d, want above 4GB", r.File[3].Name, offset)
+	}
+
+	// the footer is appended twice, the second append reads the zip64
+	// directory written by the first one
+	src := multiReaderAt{io.NewSectionReader(f, 0, r.AppendOffset())}
+	for _, channel := range []string{"xiaomi", "oppo"} {
+		footer := &bytes.Buffer{}
+		w := r.Append(footer)
+		fw, err := w.Create(channelPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(channel)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		apk := append(src[:len(src):len(src)], memorySection(footer.Bytes()))
+		if r, err = zip.NewReader(apk, apk.Size()); err != nil {
+			t.Fatalf("read appended %s: %v", channel, err)
+		}
+		checkEntries(t, r,
+			[]string{AndroidManifestPath, "assets/huge.obb", "assets/after.txt", channelPath},
+			map[string]string{AndroidManifestPath: "manifest", "assets/after.txt": "after", channelPath: channel})
+		src = multiReaderAt{io.NewSectionReader(apk, 0, r.AppendOffset())}
+	}
+}
+
+func TestWriteDirectoryZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a sparse archive above 4GB")
+	}
+	dir, err := ioutil.TempDir("", "zip64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "app.xapk")
+	writeSparseZip(t, name, []testEntry{
+		{Name: XAPKManifestPath, Data: []byte(`{"split_apks":[{"file":"com.example.apk","id":"base"}]}`)},
+		{Name: "com.example.apk", Data: []byte("base apk")},
+		{Name: "Android/obb/com.example/main.obb"},
+		{Name: "config.arm64_v8a.apk", Data: []byte("split apk")},
+	})
+	f, r := openSparseZip(t, name)
+	defer f.Close()
+	base, dataOffset, err := FindBaseAPK(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the base apk grows by the footer like repackAPKSet, the entries
+	// after it are shifted beyond 4GB
+	footer := []byte("channel footer")
+	headerOffset, baseSize := base.HeaderOffset(), int64(base.CompressedSize64)
+	size := baseSize + int64(len(footer))
+	crc := crc32Combine(base.CRC32, crc32.ChecksumIEEE(footer), int64(len(footer)))
+	header := make([]byte, dataOffset-headerOffset)
+	if _, err := f.ReadAt(header, headerOffset); err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint16(header[6:], base.Flags&^0x8)
+	binary.LittleEndian.PutUint32(header[14:], crc)
+	binary.LittleEndian.PutUint32(header[18:], uint32(size))
+	binary.LittleEndian.PutUint32(header[22:], uint32(size))
+	end := r.File[2].HeaderOffset()
+	shift := int64(len(header)) + size - (end - headerOffset)
+
+	directory := &bytes.Buffer{}
+	if _, err := writeDirectory(directory, r, base, crc, size, shift); err != nil {
+		t.Fatal(err)
+	}
+	set := multiReaderAt{
+		io.NewSectionReader(f, 0, headerOffset),
+		memorySection(header),
+		io.NewSectionReader(f, dataOffset, baseSize),
+		memorySection(footer),
+		io.NewSectionReader(f, end, r.AppendOffset()-end),
+		memorySection(directory.Bytes()),
+	}
+	out, err := zip.NewReader(set, set.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, out,
+		[]string{XAPKManifestPath, "com.example.apk", "Android/obb/com.example/main.obb", "config.arm64_v8a.apk"},
+		map[string]string{
+			XAPKManifestPath:       `{"split_apks":[{"file":"com.example.apk","id":"base"}]}`,
+			"com.example.apk":      "base apk" + string(footer),
+			"config.arm64_v8a.apk": "split apk",
+		})
+	if offset := out.File[3].HeaderOffset(); offset != r.File[3].HeaderOffset()+shift {
+		t.Errorf("offset of the split: %d, want: %d", offset, r.File[3].HeaderOffset()+shift)
+	}
+}
+
+func TestCRC32Combine(t *testing.T) {
+	buf := make([]byte, 1<<16)
+	rand.Read(buf)
+	for i := 0; i < 100; i++ {
+		n := rand.Intn(len(buf) + 1)
+		got := crc32Combine(crc32.ChecksumIEEE(buf[:n]), crc32.ChecksumIEEE(buf[n:]), int64(len(buf)-n))
+		if want := crc32.ChecksumIEEE(buf); got != want {
+			t.Fatalf("split at %d: %08x, want: %08x", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"repack/logger"
+	"repack/oss"
+	"repack/urlsign"
+	"strconv"
+	"strings"
+)
+
+// PublishDir is the default dir in the source bucket to publish channel apks
+const PublishDir = "channels/"
+
+// PublishPartSize and PublishWorkers are the part size and the parallel
+// parts of the uploads, clamped to the limits of oss
+var (
+	PublishPartSize = envInt("PUBLISH_PART_SIZE", oss.CopyPartSizeInBytes, oss.MinPartSizeInBytes, oss.MaxPartSizeInBytes)
+	PublishWorkers  = int(envInt("PUBLISH_WORKERS", oss.CopyPartWorkerCount, 1, oss.MaxWorkerCount))
+)
+
+// envInt returns the integer env var clamped to [min, max], def if it's
+// not set or invalid
+func envInt(name string, def, min, max int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		return def
+	}
+	clamped := v
+	if v < min {
+		clamped = min
+	} else if v > max {
+		clamped = max
+	}
+	if clamped != v {
+		logger.Warnf("%s %d is out of [%d, %d], use %d", name, v, min, max, clamped)
+	}
+	return clamped
+}
+
+type publishResult struct {
+	ChannelID string `json:"channel"`
+	Object    string `json:"object,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// publishTarget returns the object to publish the channel apk of fcCtx to,
+// dest is a bucket/dir/ prefix, the source bucket PublishDir if empty
+func publishTarget(fcCtx *FCContext, dest string) string {
+	if dest == "" {
+		dest = fcCtx.SourceBucket() + "/" + PublishDir
+	}
+	if !strings.HasSuffix(dest, "/") {
+		dest += "/"
+	}
+	return dest + fcCtx.NewApkFileName
+}
+
+// publishAPK writes the complete channel apk to the target object, the
+// content before the append offset is copied from the source on the server side
+func publishAPK(fcCtx *FCContext, target string) (int64, error) {
+	f, res, err := repackAPK(fcCtx)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// the footer of the apk set is not at the end, the parts copied from
+	// the source would be smaller than the min part size
+	if len(res.Segments) > 0 {
+		return 0, fmt.Errorf("publish is not supported for apk sets")
+	}
+
+	w, err := oss.NewWriter(fcCtx.OSSConfig(), target, fcCtx.SourceObject, res.Offset)
+	if err != nil {
+		return 0, fmt.Errorf("oss writer: %v", err)
+	}
+	defer w.Close()
+	// the uploads to different targets of the same channel don't share a
+	// checkpoint
+	sum := sha1.Sum([]byte(target))
+	w.CheckpointFile = filepath.Join(fcCtx.WorkDir, "publish."+hex.EncodeToString(sum[:8])+".checkpoint")
+	w.PartSize, w.WorkerCount = PublishPartSize, PublishWorkers
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, fmt.Errorf("flush %s: %v", target, err)
+	}
+
+	fcCtx.Logger.Infof("published %s, size: %d", target, res.Offset+res.FooterSize)
+	return res.Offset + res.FooterSize, nil
+}
+
+// parseChannels returns the channels of the repeated and comma separated cid
+func parseChannels(values []string) []string {
+	channels := []string{}
+	for _, v := range values {
+		for _, cid := range strings.Split(v, ",") {
+			if cid = strings.TrimSpace(cid); cid != "" {
+				channels = append(channels, cid)
+			}
+		}
+	}
+	return channels
+}
+
+// publishHandler publishes the channel apks of
+// POST /publish?src=bucket/app.apk&cid=xiaomi,huawei[&dst=bucket/dir/]
+//
+// The signature covers the channels and dst, an explicit dst is checked
+// against SourceAllowlist like the sources.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		handleError(w, r, fmt.Errorf("method %s not supported", r.Method))
+		return
+	}
+	query := r.URL.Query()
+	channels := parseChannels(query["cid"])
+	dst := query.Get("dst")
+	params := map[string]string{}
+	if dst != "" {
+		params["dst"] = dst
+	}
+	if err := verifyURL(r, query.Get("src"), urlsign.Batch(urlsign.ActionPublish, channels, params)); err != nil {
+		handleErrorCode(w, r, 403, err)
+		return
+	}
+	srcCtx, err := newSourceContext(r, query.Get("src"))
+	if err != nil {
+		handleError(w, r, fmt.Errorf("fail to NewFromContext due to  %w", err))
+		return
+	}
+	if len(channels) == 0 {
+		handleError(w, r, fmt.Errorf("no channel to publish"))
+		return
+	}
+
+	results := []publishResult{}
+	for _, cid := range channels {
+		res := publishResult{ChannelID: cid}
+		fcCtx, err := srcCtx.WithChannel(cid, nil)
+		if err == nil {
+			res.Object = publishTarget(fcCtx, dst)
+			if dst != "" {
+				err = validateTarget(res.Object)
+			}
+		}
+		if err == nil {
+			res.Size, err = publishAPK(fcCtx, res.Object)
+		}
+		if err != nil {
+			srcCtx.Logger.With("channel", cid).Errorf("publish error: %v", err)
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+
+	writeJSON(w, 200, results)
+}
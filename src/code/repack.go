@@ -1,37 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
+	"repack/logger"
 	"repack/oss"
+	"repack/packer"
 	"strings"
+	"time"
 
-	"github.com/rsc/zipmerge/zip"
+	aliyunoss "github.com/aliyun/aliyun-oss-go-sdk/oss"
 )
 
-// print error and exit
-func perror(msg string, args ...interface{}) {
-	log.Printf(msg, args...)
-	os.Exit(1)
-}
-
 type readerAt interface {
 	ReadAt(buf []byte, off int64) (int, error)
 }
 
-func copyData(name string, w http.ResponseWriter, r readerAt, offset, size int64) error {
+// sourceReader reads the source apk, it's the oss reader or the local file
+type sourceReader interface {
+	readerAt
+	Size() (int64, error)
+}
+
+func copyData(l *logger.Logger, name string, w io.Writer, r readerAt, offset, size int64) error {
 	buf := make([]byte, size)
 	n, err := r.ReadAt(buf, offset)
-	log.Printf("%s read %d, actual: %d", name, len(buf), n)
+	l.Debugf("%s read %d, actual: %d", name, len(buf), n)
 	if (err != nil && err != io.EOF) || n != len(buf) {
 		return fmt.Errorf("%s read: %v, n: %d", name, err, n)
 	}
 	n, err = w.Write(buf)
+	servedBytes.Add(float64(n), name)
 	if err != nil || n != len(buf) {
 		return fmt.Errorf("%s resp write: %v, n: %d", name, err, n)
 	}
@@ -39,33 +44,78 @@ func copyData(name string, w http.ResponseWriter, r readerAt, offset, size int64
 	return nil
 }
 
-type sizeWriter struct {
-	io.Writer
-	size int64
+type resultInfo struct {
+	Offset     int64
+	FooterSize int64
+	ETag       string
+	// Segments lays out the repacked apk set, it's empty for the apk or the
+	// bundle which is the source before Offset and the footer
+	Segments []segment `json:",omitempty"`
 }
 
-func (sw *sizeWriter) Write(buf []byte) (int, error) {
-	n, err := sw.Writer.Write(buf)
-	if err != nil {
-		return n, err
+// segment is a part of the repacked file read from the source or the footer
+type segment = packer.Segment
+
+func (res *resultInfo) segments() []segment {
+	if len(res.Segments) > 0 {
+		return res.Segments
 	}
-	sw.size += int64(n)
-	return n, err
+	return []segment{{Offset: 0, Size: res.Offset}, {Footer: true, Offset: 0, Size: res.FooterSize}}
 }
 
-func (sw *sizeWriter) Size() int64 {
-	return sw.size
+// copySegments writes [begin, end) of the repacked file, the source is read
+// from oss and the rest from the footer
+func copySegments(fcCtx *FCContext, w io.Writer, footer readerAt, res *resultInfo, begin, end int64) error {
+	var src readerAt
+	pos := int64(0)
+	for _, s := range res.segments() {
+		from, to := begin, end
+		if from < pos {
+			from = pos
+		}
+		if to > pos+s.Size {
+			to = pos + s.Size
+		}
+		offset := s.Offset + from - pos
+		pos += s.Size
+		if from >= to {
+			continue
+		}
+		r, name := footer, "footer"
+		if !s.Footer {
+			if src == nil {
+				r, err := fcCtx.openSource()
+				if err != nil {
+					return err
+				}
+				src = r
+			}
+			r, name = src, "oss"
+		}
+		fcCtx.Logger.Infof("read %s, offset: %d, size: %d", name, offset, to-from)
+		if err := copyData(fcCtx.Logger, name, w, r, offset, to-from); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type resultInfo struct {
-	Offset     int64
-	FooterSize int64
+// footerETag identifies the repacked apk by the append offset and the footer
+func footerETag(f io.ReadSeeker, offset int64) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`"%x-%d"`, h.Sum(nil), offset), nil
 }
 
 func repackAPK(fcCtx *FCContext) (*os.File, *resultInfo, error) {
-	sourceObject, channelID := fcCtx.SourceObject, fcCtx.ChannelID
-	footerFile := fmt.Sprintf("/%s/%s.%s.footer", WORK_DIR_BASE, strings.Replace(sourceObject, "/", "_", -1), channelID)
-	resultFile := fmt.Sprintf("/%s/%s.%s.meta", WORK_DIR_BASE, strings.Replace(sourceObject, "/", "_", -1), channelID)
+	sourceObject, channelKey := fcCtx.SourceObject, fcCtx.ChannelKey()
+	footerFile := fmt.Sprintf("/%s/%s.%s.footer", fcCtx.cacheDir(), strings.Replace(sourceObject, "/", "_", -1), channelKey)
+	resultFile := fmt.Sprintf("/%s/%s.%s.meta", fcCtx.cacheDir(), strings.Replace(sourceObject, "/", "_", -1), channelKey)
 
 	// try read result file
 	buf, err := ioutil.ReadFile(resultFile)
@@ -80,6 +130,7 @@ func repackAPK(fcCtx *FCContext) (*os.File, *resultInfo, error) {
 			return nil, nil, err
 		}
 
+		footerCounter.Inc("hit")
 		return file, &res, nil
 	}
 	f, err := os.Create(footerFile)
@@ -87,61 +138,112 @@ func repackAPK(fcCtx *FCContext) (*os.File, *resultInfo, error) {
 		return nil, nil, err
 	}
 
-	offset, size := doRepackAPK(f, fcCtx)
+	start := time.Now()
+	footer, err := newFooter(fcCtx)
+	if err == nil {
+		_, err = f.Write(footer.Data)
+	}
+	if err != nil {
+		footerCounter.Inc("error")
+		f.Close()
+		os.Remove(footerFile)
+		return nil, nil, err
+	}
+	footerCounter.Inc("generated")
+	generateDuration.Observe(time.Since(start).Seconds())
+	offset := footer.SourceSize()
+	etag, err := footerETag(f, offset)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
 	res := resultInfo{
 		Offset:     offset,
-		FooterSize: size,
+		FooterSize: int64(len(footer.Data)),
+		ETag:       etag,
+	}
+	// the apk set is detected by the content, not the extension of the
+	// source, its footer is not only appended to the source
+	if len(footer.Segments) > 2 {
+		res.Segments = footer.Segments
 	}
+	fcCtx.Logger.Infof("append offset: %d, footer size: %d", res.Offset, res.FooterSize)
 	buf, _ = json.Marshal(res)
 	if err := ioutil.WriteFile(resultFile, buf, 0644); err != nil {
+		f.Close()
 		return nil, nil, err
 	}
 
 	return f, &res, nil
 }
 
-func doRepackAPK(w io.Writer, fcCtx *FCContext) (int64, int64) {
-	ossReader, err := oss.NewReader(
-		oss.OSSConfig{
-			Endpoint:        fcCtx.OSSEndpoint,
-			AccessKeyID:     fcCtx.Credentials.AccessKeyID,
-			AccessKeySecret: fcCtx.Credentials.AccessKeySecret,
-			SecurityToken:   fcCtx.Credentials.SecurityToken,
-		}, fcCtx.SourceObject)
+// newFooter repacks the source of fcCtx with its channel, the crc of the base
+// apk of the apk set is cached for the source
+func newFooter(fcCtx *FCContext) (*packer.Footer, error) {
+	src, err := fcCtx.openSource()
 	if err != nil {
-		perror("oss reader: %v", err)
+		return nil, err
 	}
-	objectSize, err := ossReader.Size()
+	objectSize, err := src.Size()
 	if err != nil {
-		perror("object size: %v", err)
+		return nil, fmt.Errorf("object size: %v", err)
 	}
-
-	zipReader, err := zip.NewReader(ossReader, objectSize)
+	ch, err := fcCtx.packerChannel()
 	if err != nil {
-		perror("zip reader: %v", err)
+		return nil, err
 	}
-	appendOffset := zipReader.AppendOffset()
-	log.Printf("append offset: %d", appendOffset)
 
-	err = changeManifest(zipReader, fcCtx)
+	signer, err := fcCtx.signer()
 	if err != nil {
-		perror("change manifest: %v", err)
+		return nil, fmt.Errorf("load signer: %v", err)
 	}
-	sizeWriter := &sizeWriter{Writer: w}
-
-	writer := zipReader.Append(sizeWriter)
+	p := &packer.Packer{
+		Signer: timedSigner{signer},
+		PrefixCRC: func(offset, size int64) (uint32, error) {
+			return basePrefixCRC(fcCtx, src, offset, size)
+		},
+		Logger: fcCtx.Logger,
+	}
+	return p.Repack(context.Background(), src, objectSize, ch)
+}
 
-	// copy cpid file
-	if err := copyCPID(writer, fcCtx.ChannelID); err != nil {
-		perror("copy cpid: %v", err)
+// basePrefixCRC returns the crc of the base apk before the append offset, it's
+// the same for all channels so it's computed once for the source
+func basePrefixCRC(fcCtx *FCContext, r sourceReader, offset, size int64) (uint32, error) {
+	type prefixCRC struct {
+		Offset int64
+		Size   int64
+		CRC32  uint32
 	}
-	// copy meta files: MANIFEST.MF/CERT.SF/CERT.RSA
-	if err := copyMeta(writer, fcCtx); err != nil {
-		perror("copy meta: %v", err)
+	crcFile := fmt.Sprintf("/%s/%s.base.crc", fcCtx.cacheDir(), strings.Replace(fcCtx.SourceObject, "/", "_", -1))
+	var res prefixCRC
+	if buf, err := ioutil.ReadFile(crcFile); err == nil && json.Unmarshal(buf, &res) == nil &&
+		res.Offset == offset && res.Size == size {
+		return res.CRC32, nil
 	}
 
-	writer.Close()
-
-	log.Printf("append offset: %d, footer size: %d", appendOffset, sizeWriter.Size())
-	return appendOffset, sizeWriter.Size()
+	res = prefixCRC{Offset: offset, Size: size}
+	if size > 0 {
+		var prefix io.Reader = io.NewSectionReader(r, offset, size)
+		if or, ok := r.(*oss.Reader); ok {
+			// one ranged get instead of the buffered reads of ReadAt
+			resp, err := or.Client.GetObject(or.Object, aliyunoss.Range(offset, offset+size-1))
+			if err != nil {
+				return 0, err
+			}
+			defer resp.Close()
+			prefix = resp
+		}
+		h := crc32.NewIEEE()
+		if n, err := io.Copy(h, prefix); err != nil || n != size {
+			return 0, fmt.Errorf("read base apk: %v, n: %d", err, n)
+		}
+		res.CRC32 = h.Sum32()
+	}
+	buf, _ := json.Marshal(res)
+	tmp := fmt.Sprintf("%s.%d.tmp", crcFile, os.Getpid())
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return 0, err
+	}
+	return res.CRC32, os.Rename(tmp, crcFile)
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"repack/logger"
+	"repack/packer"
+	"testing"
+)
+
+// writeTestZip writes the stored entries to a zip, the entries are written
+// in order of names
+func writeTestZip(t *testing.T, names []string, entries map[string][]byte) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, name := range names {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(entries[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestRepackAPKSetByContent repacks an apk set named .zip, it's laid out by
+// the segments though the extension is not of an apk set
+func TestRepackAPKSetByContent(t *testing.T) {
+	dir := t.TempDir()
+	entries := map[string][]byte{
+		"AndroidManifest.xml": []byte("manifest"),
+		"classes.dex":         []byte("dex"),
+	}
+	mf := "Manifest-Version: 1.0\r\n\r\n"
+	for _, name := range []string{"AndroidManifest.xml", "classes.dex"} {
+		sum := sha256.Sum256(entries[name])
+		mf += "Name: " + name + "\r\nSHA-256-Digest: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n"
+	}
+	entries["META-INF/MANIFEST.MF"] = []byte(mf)
+	base := writeTestZip(t, []string{"AndroidManifest.xml", "classes.dex", "META-INF/MANIFEST.MF"}, entries)
+	set := writeTestZip(t, []string{"toc.pb", "splits/base-master.apk", "splits/base-arm64_v8a.apk"}, map[string][]byte{
+		"toc.pb":                    []byte("toc"),
+		"splits/base-master.apk":    base,
+		"splits/base-arm64_v8a.apk": []byte("split"),
+	})
+	name := filepath.Join(dir, "app.zip")
+	if err := ioutil.WriteFile(name, set, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	signer, err := packer.LoadKeySigner("target/cert/test-cert.pem", "target/cert/test-priv.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcCtx := &FCContext{
+		SourceObject: LocalSourceBucket + "/app.zip",
+		Source:       &localSource{f},
+		CacheDir:     filepath.Join(dir, "cache"),
+		Signer:       signer,
+		Logger:       logger.With("src", name),
+	}
+	if srcCtx.IsAPKSet() {
+		t.Fatalf("app.zip is named as an apk set")
+	}
+	fcCtx, err := srcCtx.WithChannel("xiaomi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second repack reads the cached footer and result
+	for i := 0; i < 2; i++ {
+		out := filepath.Join(dir, "out.zip")
+		res, err := repackToFile(fcCtx, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Segments) <= 2 {
+			t.Fatalf("segments: %+v, want the apk set layout", res.Segments)
+		}
+		buf, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(buf)) != res.Offset+res.FooterSize {
+			t.Errorf("size: %d, want %d", len(buf), res.Offset+res.FooterSize)
+		}
+		if _, err := packer.Verify(bytes.NewReader(buf), int64(len(buf))); err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+
+		r, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string]*zip.File{}
+		for _, e := range r.File {
+			files[e.Name] = e
+		}
+		if len(files) != 3 || files["toc.pb"] == nil || files["splits/base-arm64_v8a.apk"] == nil {
+			t.Fatalf("entries: %v", files)
+		}
+		rc, err := files["splits/base-master.apk"].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseAPK, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		baseReader, err := zip.NewReader(bytes.NewReader(baseAPK), int64(len(baseAPK)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, e := range baseReader.File {
+			found = found || e.Name == CPIDPath
+		}
+		if !found {
+			t.Errorf("%s is not in the base apk", CPIDPath)
+		}
+	}
+}
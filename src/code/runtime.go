@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// runtimes of the service
+const (
+	// RuntimeFC is the custom runtime of aliyun function compute, the
+	// credentials and the region are in the x-fc-* headers of the requests
+	RuntimeFC = "fc"
+	// RuntimeGeneric is a plain linux server, a docker container or a
+	// kubernetes pod, the credentials are in the config file or the env vars
+	RuntimeGeneric = "generic"
+)
+
+// Runtime adapts the service to where it runs
+type Runtime interface {
+	// Name is one of the Runtime consts
+	Name() string
+	// Addr is the listen address of the http server
+	Addr() string
+	// RequestID returns the id of req in the logs
+	RequestID(req *http.Request) string
+	// Context returns the context of req with the request id, the credentials
+	// and the oss endpoint, the source and the channel are left empty
+	Context(req *http.Request) (*FCContext, error)
+	// Background reports whether the goroutines keep running between the
+	// requests, the jobs are run by the async invocations of the function
+	// if not
+	Background() bool
+}
+
+// serverRuntime is the runtime of the http server, it's set in main
+var serverRuntime Runtime = &fcRuntime{}
+
+// newRuntime returns the runtime by name of RUNTIME, it's function compute
+// if the FC_FUNCTION_NAME env var is set by it and generic otherwise
+func newRuntime(name string) (Runtime, error) {
+	if name == "" {
+		name = RuntimeGeneric
+		if os.Getenv("FC_FUNCTION_NAME") != "" {
+			name = RuntimeFC
+		}
+	}
+	switch name {
+	case RuntimeFC:
+		return newFCRuntime(), nil
+	case RuntimeGeneric:
+		return newGenericRuntime(os.Getenv("RUNTIME_CONFIG"))
+	}
+	return nil, fmt.Errorf("unknown runtime: %s", name)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// fcRuntime reads the context from the x-fc-* headers, the oss endpoint is
+// the internal one of the region
+type fcRuntime struct {
+	port string
+}
+
+func newFCRuntime() *fcRuntime {
+	// the port of customRuntimeConfig in s.yaml
+	port := os.Getenv("FC_SERVER_PORT")
+	if port == "" {
+		port = "80"
+	}
+	return &fcRuntime{port: port}
+}
+
+func (rt *fcRuntime) Name() string {
+	return RuntimeFC
+}
+
+func (rt *fcRuntime) Addr() string {
+	return ":" + rt.port
+}
+
+// Background is false, function compute freezes the instance once the
+// requests are served
+func (rt *fcRuntime) Background() bool {
+	return false
+}
+
+func (rt *fcRuntime) RequestID(req *http.Request) string {
+	return req.Header.Get(fcRequestID)
+}
+
+func (rt *fcRuntime) Context(req *http.Request) (*FCContext, error) {
+	mStr := req.Header.Get(fcFunctionMemory)
+	m, err := strconv.Atoi(mStr)
+	if err != nil {
+		m = -1
+	}
+	tStr := req.Header.Get(fcFunctionTimeout)
+	t, err := strconv.Atoi(tStr)
+	if err != nil {
+		t = -1
+	}
+	itStr := req.Header.Get(fcInitializationTimeout)
+	it, err := strconv.Atoi(itStr)
+	if err != nil {
+		it = -1
+	}
+
+	return &FCContext{
+		RequestID: req.Header.Get(fcRequestID),
+		Credentials: Credentials{
+			AccessKeyID:     req.Header.Get(fcAccessKeyID),
+			AccessKeySecret: req.Header.Get(fcAccessKeySecret),
+			SecurityToken:   req.Header.Get(fcSecurityToken),
+		},
+		Function: FunctionMeta{
+			Name:                  req.Header.Get(fcFunctionName),
+			Handler:               req.Header.Get(fcFunctionHandler),
+			Memory:                m,
+			Timeout:               t,
+			Initializer:           req.Header.Get(fcFunctionInitializer),
+			InitializationTimeout: it,
+		},
+		Service: ServiceMeta{
+			ServiceName: req.Header.Get(fcServiceName),
+			LogProject:  req.Header.Get(fcServiceLogProject),
+			LogStore:    req.Header.Get(fcServiceLogstore),
+			Qualifier:   req.Header.Get(fcQualifier),
+			VersionID:   req.Header.Get(fcVersionID),
+		},
+		Region:      req.Header.Get(fcRegion),
+		AccountID:   req.Header.Get(fcAccountID),
+		OSSEndpoint: internalOSSEndpoint(req.Header.Get(fcRegion)),
+	}, nil
+}
+
+// internalOSSEndpoint returns the oss endpoint of the region in the vpc
+func internalOSSEndpoint(region string) string {
+	return fmt.Sprintf("http://oss-%s-internal.aliyuncs.com", region)
+}
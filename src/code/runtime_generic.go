@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is the request id of the proxies in the generic runtime
+const RequestIDHeader = "X-Request-Id"
+
+// genericConfig is the config of the generic runtime, it's read from the json
+// file of RUNTIME_CONFIG and the env vars override its fields
+type genericConfig struct {
+	// Listen is the listen address or port, :80 if empty
+	Listen string `json:"listen"`
+	// Region derives the public oss endpoint if OSSEndpoint is empty
+	Region          string `json:"region"`
+	OSSEndpoint     string `json:"oss_endpoint"`
+	AccessKeyID     string `json:"access_key_id"`
+	AccessKeySecret string `json:"access_key_secret"`
+	SecurityToken   string `json:"security_token"`
+	// WorkDir is the cache of the footers, WORK_DIR_BASE if empty
+	WorkDir string `json:"work_dir"`
+	Cert    string `json:"cert"`
+	Key     string `json:"key"`
+}
+
+// genericEnv are the env vars of the fields of genericConfig
+var genericEnv = []struct {
+	name  string
+	field func(c *genericConfig) *string
+}{
+	{"LISTEN_ADDR", func(c *genericConfig) *string { return &c.Listen }},
+	{"REGION", func(c *genericConfig) *string { return &c.Region }},
+	{"OSS_ENDPOINT", func(c *genericConfig) *string { return &c.OSSEndpoint }},
+	{"ACCESS_KEY_ID", func(c *genericConfig) *string { return &c.AccessKeyID }},
+	{"ACCESS_KEY_SECRET", func(c *genericConfig) *string { return &c.AccessKeySecret }},
+	{"SECURITY_TOKEN", func(c *genericConfig) *string { return &c.SecurityToken }},
+	{"WORK_DIR", func(c *genericConfig) *string { return &c.WorkDir }},
+	{"CERT_PATH", func(c *genericConfig) *string { return &c.Cert }},
+	{"KEY_PATH", func(c *genericConfig) *string { return &c.Key }},
+}
+
+// loadGenericConfig reads the config file if it's not empty, then the env
+// vars
+func loadGenericConfig(file string) (*genericConfig, error) {
+	c := &genericConfig{}
+	if file != "" {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(buf, c); err != nil {
+			return nil, fmt.Errorf("invalid runtime config %s: %v", file, err)
+		}
+	}
+	for _, e := range genericEnv {
+		if v := os.Getenv(e.name); v != "" {
+			*e.field(c) = v
+		}
+	}
+	if c.OSSEndpoint == "" {
+		if c.Region == "" {
+			return nil, fmt.Errorf("oss_endpoint or region is required")
+		}
+		c.OSSEndpoint = fmt.Sprintf("https://oss-%s.aliyuncs.com", c.Region)
+	}
+	return c, nil
+}
+
+// genericRuntime has the same credentials for all requests, the config file
+// is read again once it's changed, e.g. the sts token of a kubernetes secret
+// is rotated
+type genericRuntime struct {
+	file string
+
+	mu      sync.Mutex
+	config  *genericConfig
+	modTime time.Time
+}
+
+// newGenericRuntime loads the config, the work dir and the signer of it are
+// set as the defaults
+func newGenericRuntime(file string) (*genericRuntime, error) {
+	rt := &genericRuntime{file: file}
+	c, err := rt.load()
+	if err != nil {
+		return nil, err
+	}
+	if c.WorkDir != "" {
+		WORK_DIR_BASE = c.WorkDir
+	}
+	if c.Cert != "" {
+		CertPEM_PATH = c.Cert
+	}
+	if c.Key != "" {
+		PrivateKeyPEM_PATH = c.Key
+	}
+	return rt, nil
+}
+
+// load returns the config, the file is read if it's modified since the last
+// load
+func (rt *genericRuntime) load() (*genericConfig, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var modTime time.Time
+	if rt.file != "" {
+		fi, err := os.Stat(rt.file)
+		if err != nil {
+			return nil, err
+		}
+		modTime = fi.ModTime()
+	}
+	if rt.config != nil && modTime.Equal(rt.modTime) {
+		return rt.config, nil
+	}
+	c, err := loadGenericConfig(rt.file)
+	if err != nil {
+		return nil, err
+	}
+	rt.config, rt.modTime = c, modTime
+	return c, nil
+}
+
+func (rt *genericRuntime) Name() string {
+	return RuntimeGeneric
+}
+
+func (rt *genericRuntime) Addr() string {
+	c, _ := rt.load()
+	if c == nil || c.Listen == "" {
+		return ":80"
+	}
+	if !strings.Contains(c.Listen, ":") {
+		return ":" + c.Listen
+	}
+	return c.Listen
+}
+
+func (rt *genericRuntime) Background() bool {
+	return true
+}
+
+func (rt *genericRuntime) RequestID(req *http.Request) string {
+	return req.Header.Get(RequestIDHeader)
+}
+
+func (rt *genericRuntime) Context(req *http.Request) (*FCContext, error) {
+	c, err := rt.load()
+	if err != nil {
+		return nil, fmt.Errorf("load runtime config: %v", err)
+	}
+	return &FCContext{
+		RequestID: rt.RequestID(req),
+		Credentials: Credentials{
+			AccessKeyID:     c.AccessKeyID,
+			AccessKeySecret: c.AccessKeySecret,
+			SecurityToken:   c.SecurityToken,
+		},
+		Region:      c.Region,
+		OSSEndpoint: c.OSSEndpoint,
+	}, nil
+}
@@ -0,0 +1,23 @@
+package urlsign
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PayloadFlag collects the repeated -p key=value flags of the channel payload
+// fields
+type PayloadFlag map[string]string
+
+func (p PayloadFlag) String() string {
+	return Channel("", p)
+}
+
+func (p PayloadFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expect key=value: %s", s)
+	}
+	p[kv[0]] = kv[1]
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package urlsign signs and verifies the download urls. A signature is the
+// hex HMAC-SHA256 of the source object, the channel and the expiry unix
+// timestamp, so a url can't be reused for another source or channel. The
+// requests of several channels sign the action and the channel list in place
+// of the channel, see Batch, and the routes of a job sign its id, see Job.
+package urlsign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameters of the signature
+const (
+	ExpiresParam   = "expires"
+	SignatureParam = "sign"
+	// PayloadPrefix prefixes the query parameters of the channel payload
+	PayloadPrefix = "p."
+)
+
+// actions of the requests of several channels
+const (
+	ActionBatch   = "batch"
+	ActionPublish = "publish"
+	ActionJobs    = "jobs"
+)
+
+// errors ...
+var (
+	ErrMissingSignature = errors.New("urlsign: missing signature")
+	ErrInvalidExpires   = errors.New("urlsign: invalid expires")
+	ErrExpired          = errors.New("urlsign: url expired")
+	ErrInvalidSignature = errors.New("urlsign: invalid signature")
+)
+
+// Sign returns the signature of src and cid expiring at the unix timestamp
+func Sign(secret []byte, src, cid string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(src))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(cid))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Query returns the signed query of src and cid valid for ttl
+func Query(secret []byte, src, cid string, ttl time.Duration) url.Values {
+	return ChannelQuery(secret, src, cid, nil, ttl)
+}
+
+// ChannelQuery returns the signed query of src, cid and its payload fields
+// valid for ttl
+func ChannelQuery(secret []byte, src, cid string, payload map[string]string, ttl time.Duration) url.Values {
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("src", src)
+	if cid != "" {
+		q.Set("cid", cid)
+	}
+	for k, v := range payload {
+		q.Set(PayloadPrefix+k, v)
+	}
+	q.Set(ExpiresParam, strconv.FormatInt(expires, 10))
+	q.Set(SignatureParam, Sign(secret, src, Channel(cid, payload), expires))
+	return q
+}
+
+// Verify checks the expires and signature parameters of query against src and cid
+func Verify(secret []byte, query url.Values, src, cid string, now time.Time) error {
+	sig, expiresStr := query.Get(SignatureParam), query.Get(ExpiresParam)
+	if sig == "" || expiresStr == "" {
+		return ErrMissingSignature
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return ErrInvalidExpires
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	expected := Sign(secret, src, cid, expires)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Channel returns the channel string to sign for cid and its payload fields,
+// the payload is appended as a sorted query string, e.g. "xiaomi?campaign=spring"
+func Channel(cid string, payload map[string]string) string {
+	if len(payload) == 0 {
+		return cid
+	}
+	q := url.Values{}
+	for k, v := range payload {
+		q.Set(k, v)
+	}
+	return cid + "?" + q.Encode()
+}
+
+// Batch returns the channel string to sign for the action on the channels,
+// params are the other signed query parameters, e.g. dst of publish:
+// "publish:huawei,xiaomi?dst=bucket%2Fdir%2F". The channels are sorted and
+// deduplicated, a channel id can't contain ':' so it's never a download
+// channel string.
+func Batch(action string, channels []string, params map[string]string) string {
+	seen := map[string]bool{}
+	list := []string{}
+	for _, cid := range channels {
+		if cid != "" && !seen[cid] {
+			seen[cid] = true
+			list = append(list, cid)
+		}
+	}
+	sort.Strings(list)
+	return action + ":" + Channel(strings.Join(list, ","), params)
+}
+
+// Job returns the channel string to sign for the routes of the job id, it's
+// signed with an empty source
+func Job(id string) string {
+	return "job:" + id
+}
+
+// JobQuery returns the signed query of the routes of the job id valid for ttl
+func JobQuery(secret []byte, id string, ttl time.Duration) url.Values {
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set(ExpiresParam, strconv.FormatInt(expires, 10))
+	q.Set(SignatureParam, Sign(secret, "", Job(id), expires))
+	return q
+}
+
+// BatchQuery returns the signed query of src for the action on the channels
+// valid for ttl, params are set in the query as is. The channels are in the
+// query only for publish, they're in the POST body of the others.
+func BatchQuery(secret []byte, src, action string, channels []string, params map[string]string, ttl time.Duration) url.Values {
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("src", src)
+	if action == ActionPublish {
+		q.Set("cid", strings.Join(channels, ","))
+	}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	q.Set(ExpiresParam, strconv.FormatInt(expires, 10))
+	q.Set(SignatureParam, Sign(secret, src, Batch(action, channels, params), expires))
+	return q
+}
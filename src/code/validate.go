@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// MaxChannelIDLength ...
+const MaxChannelIDLength = 64
+
+// SourceAllowAll is the pattern of SourceAllowlist matching all objects
+const SourceAllowAll = "*"
+
+var (
+	// SourceAllowlist is the comma separated patterns of the allowed sources,
+	// e.g. "bucket/apks/*.apk,bucket2/games/", a pattern ending with "/"
+	// allows all objects under the prefix, SourceAllowAll allows all objects,
+	// others are matched by path.Match. All sources are denied if empty.
+	SourceAllowlist = splitList(os.Getenv("SOURCE_ALLOWLIST"))
+
+	channelIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+)
+
+// httpError is an error with the status code to respond
+type httpError struct {
+	Code int
+	Err  error
+}
+
+func (e *httpError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.Err
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{Code: 400, Err: fmt.Errorf(format, args...)}
+}
+
+func forbidden(format string, args ...interface{}) error {
+	return &httpError{Code: 403, Err: fmt.Errorf(format, args...)}
+}
+
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// validateSource checks src is a well-formed bucket/objectkey allowed by
+// SourceAllowlist
+func validateSource(src string) error {
+	return validateObject("src", src)
+}
+
+// validateTarget checks the object to publish to is allowed by
+// SourceAllowlist like the sources, dst is the query parameter of it
+func validateTarget(target string) error {
+	return validateObject("dst", target)
+}
+
+// validateObject checks the object of the query parameter param is a
+// well-formed bucket/objectkey allowed by SourceAllowlist
+func validateObject(param, object string) error {
+	bucketAndObject := strings.SplitN(object, "/", 2)
+	if len(bucketAndObject) != 2 || bucketAndObject[0] == "" || bucketAndObject[1] == "" {
+		return badRequest("%s = %s is invalid, the format is bucket/objectkey", param, object)
+	}
+	for _, r := range object {
+		if r < 0x20 || r == 0x7f || r == '\\' {
+			return badRequest("%s = %q contains invalid character %q", param, object, r)
+		}
+	}
+	for _, seg := range strings.Split(bucketAndObject[1], "/") {
+		if seg == "." || seg == ".." {
+			return badRequest("%s = %s contains path traversal", param, object)
+		}
+	}
+
+	if err := checkAllowlist(); err != nil {
+		return &httpError{Code: 403, Err: err}
+	}
+	for _, pattern := range SourceAllowlist {
+		if matchSource(pattern, object) {
+			return nil
+		}
+	}
+	return forbidden("%s = %s is not in the allowlist", param, object)
+}
+
+// checkAllowlist reports whether any source is allowed
+func checkAllowlist() error {
+	if len(SourceAllowlist) == 0 {
+		return fmt.Errorf("SOURCE_ALLOWLIST is not set, all objects are denied, set it to %q to allow all", SourceAllowAll)
+	}
+	return nil
+}
+
+// validateChannel checks the channel id is safe to use in file names: at most
+// MaxChannelIDLength letters, digits, '_', '.' or '-', not starting with a
+// symbol and without ".."
+func validateChannel(channelID string) error {
+	if channelID == "" {
+		return badRequest("cid is required")
+	}
+	if len(channelID) > MaxChannelIDLength {
+		return badRequest("cid is too long: %d, max: %d", len(channelID), MaxChannelIDLength)
+	}
+	if !channelIDPattern.MatchString(channelID) {
+		return badRequest("cid = %q is invalid, only letters, digits, '_', '.' and '-' are allowed", channelID)
+	}
+	if strings.Contains(channelID, "..") {
+		return badRequest("cid = %s contains path traversal", channelID)
+	}
+	return nil
+}
+
+// matchSource reports whether src matches the pattern, a pattern ending with
+// "/" matches all objects under the prefix, SourceAllowAll matches all, others
+// are matched by path.Match
+func matchSource(pattern, src string) bool {
+	if pattern == SourceAllowAll {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(src, pattern)
+	}
+	ok, _ := path.Match(pattern, src)
+	return ok
+}